@@ -0,0 +1,145 @@
+package gracefulserver
+
+import (
+	"encoding/json"
+	"expvar"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AdminMux serves the admin listener started by Serve when AdminAddr is
+// set. It has pprof under /debug/pprof/, expvar at /debug/vars, and
+// /debug/buildinfo, /debug/config, /debug/loglevel, /debug/runtime and
+// /debug/slow.
+// Applications may add their own handlers.
+var AdminMux = newAdminMux()
+
+func newAdminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/buildinfo", func(w http.ResponseWriter, r *http.Request) {
+		bi, ok := debug.ReadBuildInfo()
+		if !ok {
+			http.Error(w, "build info not available", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(bi.String()))
+	})
+	mux.HandleFunc("/debug/config", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, currentConfig())
+	})
+	mux.HandleFunc("/debug/loglevel", serveLogLevel)
+	mux.HandleFunc("/debug/runtime", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{
+			"goroutines":  runtime.NumGoroutine(),
+			"gomaxprocs":  runtime.GOMAXPROCS(0),
+			"num_cpu":     runtime.NumCPU(),
+			"go_version":  runtime.Version(),
+			"connections": conns.counts(),
+		})
+	})
+	mux.HandleFunc("/debug/slow", serveSlow)
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// currentConfig reports the settings Serve uses.
+func currentConfig() map[string]any {
+	return map[string]any{
+		"timeout":       Timeout.String(),
+		"idle_timeout":  IdleTimeout.String(),
+		"middleware":    len(Middleware),
+		"tls":           CertFile != "" && KeyFile != "",
+		"cert_file":     CertFile,
+		"redirect_addr": RedirectAddr,
+		"h2c":           H2C,
+		"http2":         HTTP2,
+		"http3":         HTTP3 != nil,
+		"grpc":          GRPC != nil,
+		"admin_addr":    AdminAddr,
+		"config_file":   ConfigFile,
+		"log_level":     LogLevel.Level().String(),
+		"signals":       !DisableSignals,
+	}
+}
+
+// adminAddr returns AdminAddr, bound to localhost if it has no host.
+func adminAddr() string {
+	host, port, err := net.SplitHostPort(AdminAddr)
+	if err != nil || host != "" {
+		return AdminAddr
+	}
+	return net.JoinHostPort("localhost", port)
+}
+
+// guardDebug hides the handlers net/http/pprof and expvar register on
+// http.DefaultServeMux, so they are only served by the admin listener.
+func guardDebug(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/debug/pprof/") || r.URL.Path == "/debug/vars" {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// connStates tracks the state of the main listener's connections.
+type connStates struct {
+	mu       sync.Mutex
+	state    map[net.Conn]http.ConnState
+	hijacked int
+	closed   int
+	since    time.Time
+}
+
+var conns = &connStates{state: make(map[net.Conn]http.ConnState), since: time.Now()}
+
+func (cs *connStates) track(c net.Conn, state http.ConnState) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	switch state {
+	case http.StateHijacked:
+		cs.hijacked++
+		delete(cs.state, c)
+	case http.StateClosed:
+		cs.closed++
+		delete(cs.state, c)
+	default:
+		cs.state[c] = state
+	}
+}
+
+func (cs *connStates) counts() map[string]int {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	counts := map[string]int{
+		"new":      0,
+		"active":   0,
+		"idle":     0,
+		"hijacked": cs.hijacked,
+		"closed":   cs.closed,
+	}
+	for _, state := range cs.state {
+		counts[state.String()]++
+	}
+	return counts
+}
@@ -0,0 +1,279 @@
+package gracefulserver
+
+import (
+	"bufio"
+	"cmp"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AsyncLog is an AccessLogger that queues entries and writes them on a
+// background goroutine, so requests don't wait on the disk. Entries that
+// arrive while the queue is full are dropped and counted.
+//
+// When Path is set it writes to that file, rotating it by size or age.
+// Serve reopens the file on ReloadSignals, for use with logrotate's
+// create mode, and flushes the queue before it returns.
+type AsyncLog struct {
+	// Path is the file to append to. If empty, Writer is used.
+	Path string
+	// Writer receives the log when Path is empty. It defaults to
+	// os.Stderr.
+	Writer io.Writer
+	// BufferSize is the number of entries that can be queued. It defaults
+	// to 1024.
+	BufferSize int
+	// Format formats an entry logged at t as a line. It defaults to t in
+	// RFC 3339 followed by Entry.String.
+	Format func(t time.Time, e *Entry) string
+	// MaxSize, if set, rotates the file before it grows past that many
+	// bytes.
+	MaxSize int64
+	// RotateEvery, if set, rotates the file once it is that old.
+	RotateEvery time.Duration
+	// MaxBackups, if set, is the number of rotated files kept.
+	MaxBackups int
+	// Compress gzips rotated files.
+	Compress bool
+
+	once    sync.Once
+	queue   chan logItem
+	done    chan struct{}
+	dropped atomic.Int64
+	// mu guards sending on queue against Close closing it.
+	mu     sync.RWMutex
+	closed bool
+
+	// Owned by the writing goroutine.
+	file       *os.File
+	bw         *bufio.Writer
+	size       int64
+	opened     time.Time
+	compressWG sync.WaitGroup
+}
+
+type logItem struct {
+	t    time.Time
+	e    Entry
+	ctl  func() error
+	errc chan error
+}
+
+func (al *AsyncLog) start() {
+	al.once.Do(func() {
+		al.queue = make(chan logItem, cmp.Or(al.BufferSize, 1024))
+		al.done = make(chan struct{})
+		if err := al.open(); err != nil {
+			errorf("Could not open access log: %v", err)
+		}
+		go al.run()
+	})
+}
+
+// LogAccess implements AccessLogger.
+func (al *AsyncLog) LogAccess(e *Entry) {
+	al.start()
+	al.mu.RLock()
+	defer al.mu.RUnlock()
+	if al.closed {
+		return
+	}
+	select {
+	case al.queue <- logItem{t: time.Now(), e: *e}:
+	default:
+		al.dropped.Add(1)
+	}
+}
+
+// Flush waits until the entries queued so far are written.
+func (al *AsyncLog) Flush() error {
+	return al.do(func() error { return al.bw.Flush() })
+}
+
+// Reopen closes and reopens Path, after it has been moved aside.
+func (al *AsyncLog) Reopen() error {
+	return al.do(func() error {
+		if al.Path == "" {
+			return nil
+		}
+		err := al.closeFile()
+		return errors.Join(err, al.open())
+	})
+}
+
+// Close flushes the queue and closes the file. Entries logged after Close
+// are discarded.
+func (al *AsyncLog) Close() error {
+	err := al.Flush()
+	al.mu.Lock()
+	if al.closed {
+		al.mu.Unlock()
+		return err
+	}
+	al.closed = true
+	close(al.queue)
+	al.mu.Unlock()
+	<-al.done
+	al.compressWG.Wait()
+	return errors.Join(err, al.closeFile())
+}
+
+// do runs f on the writing goroutine once the entries ahead of it are
+// written.
+func (al *AsyncLog) do(f func() error) error {
+	al.start()
+	errc := make(chan error, 1)
+	al.mu.RLock()
+	if al.closed {
+		al.mu.RUnlock()
+		return nil
+	}
+	// Unlike entries, control items wait for room in the queue.
+	al.queue <- logItem{ctl: f, errc: errc}
+	al.mu.RUnlock()
+	return <-errc
+}
+
+func (al *AsyncLog) run() {
+	defer close(al.done)
+	for item := range al.queue {
+		if item.ctl != nil {
+			item.errc <- item.ctl()
+			continue
+		}
+		al.write(item)
+		if len(al.queue) == 0 {
+			if err := al.bw.Flush(); err != nil {
+				errorf("Could not write access log: %v", err)
+			}
+		}
+	}
+	al.bw.Flush()
+}
+
+func (al *AsyncLog) write(item logItem) {
+	if dropped := al.dropped.Swap(0); dropped > 0 {
+		warnf("Access log queue full, dropped %d entries", dropped)
+	}
+
+	var line string
+	if al.Format != nil {
+		line = al.Format(item.t, &item.e)
+	} else {
+		line = item.t.Format(time.RFC3339) + " " + item.e.String()
+	}
+	if line == "" || line[len(line)-1] != '\n' {
+		line += "\n"
+	}
+	if al.file != nil && (al.MaxSize > 0 && al.size > 0 && al.size+int64(len(line)) > al.MaxSize ||
+		al.RotateEvery > 0 && item.t.Sub(al.opened) >= al.RotateEvery) {
+		if err := al.rotate(); err != nil {
+			errorf("Could not rotate access log: %v", err)
+		}
+	}
+	n, _ := al.bw.WriteString(line)
+	al.size += int64(n)
+}
+
+func (al *AsyncLog) open() error {
+	if al.Path == "" {
+		al.bw = bufio.NewWriter(cmp.Or[io.Writer](al.Writer, os.Stderr))
+		return nil
+	}
+	f, err := os.OpenFile(al.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		// Keep writing somewhere rather than losing every entry.
+		al.bw = bufio.NewWriter(os.Stderr)
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		al.bw = bufio.NewWriter(os.Stderr)
+		return err
+	}
+	al.file = f
+	al.bw = bufio.NewWriter(f)
+	al.size = fi.Size()
+	al.opened = time.Now()
+	return nil
+}
+
+func (al *AsyncLog) closeFile() error {
+	err := al.bw.Flush()
+	if al.file != nil {
+		err = errors.Join(err, al.file.Close())
+		al.file = nil
+	}
+	return err
+}
+
+// rotate moves the file aside with a timestamp suffix and starts a new one.
+func (al *AsyncLog) rotate() error {
+	if err := al.closeFile(); err != nil {
+		errorf("Could not close access log: %v", err)
+	}
+	backup := al.Path + "." + time.Now().Format("20060102T150405.000")
+	if err := os.Rename(al.Path, backup); err != nil {
+		return errors.Join(err, al.open())
+	}
+	if err := al.open(); err != nil {
+		return err
+	}
+	al.compressWG.Add(1)
+	go func() {
+		defer al.compressWG.Done()
+		if al.Compress {
+			if err := gzipFile(backup); err != nil {
+				errorf("Could not compress access log: %v", err)
+			}
+		}
+		al.removeBackups()
+	}()
+	return nil
+}
+
+// removeBackups deletes rotated files beyond MaxBackups, oldest first.
+func (al *AsyncLog) removeBackups() {
+	if al.MaxBackups <= 0 {
+		return
+	}
+	backups, _ := filepath.Glob(al.Path + ".[0-9]*")
+	// Timestamps sort in order, with or without the .gz suffix.
+	slices.Sort(backups)
+	backups = slices.CompactFunc(backups, func(a, b string) bool {
+		return b == a+".gz"
+	})
+	for len(backups) > al.MaxBackups {
+		os.Remove(backups[0])
+		os.Remove(backups[0] + ".gz")
+		backups = backups[1:]
+	}
+}
+
+func gzipFile(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(name+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	err = errors.Join(err, zw.Close(), dst.Close())
+	if err != nil {
+		os.Remove(name + ".gz")
+		return err
+	}
+	return os.Remove(name)
+}
@@ -0,0 +1,191 @@
+package gracefulserver
+
+import (
+	"bufio"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Decoder returns a reader that decompresses r.
+type Decoder func(r io.Reader) (io.ReadCloser, error)
+
+// BodyLimit is middleware that limits the size of request bodies. Requests
+// over the limit get a 413. It can also decompress request bodies sent with
+// a Content-Encoding, with a separate limit on the decompressed size to
+// guard against decompression bombs. Add its Wrap method to Middleware to
+// use it.
+type BodyLimit struct {
+	// Max is the largest request body accepted, in bytes. Zero means no
+	// limit.
+	Max int64
+	// Routes overrides Max for request paths starting with a prefix. The
+	// longest matching prefix wins. A negative value means no limit.
+	Routes map[string]int64
+	// Decompress enables decoding of request bodies with a Content-Encoding.
+	// Requests with an unknown encoding get a 415.
+	Decompress bool
+	// Decoders adds or replaces decoders by content coding name, e.g.
+	// "zstd". Gzip and deflate are built in.
+	Decoders map[string]Decoder
+	// MaxDecompressed is the largest decompressed body accepted, in bytes.
+	// It defaults to the limit for the route, or 10 MB if that is unlimited.
+	MaxDecompressed int64
+}
+
+func (bl *BodyLimit) limit(path string) int64 {
+	limit, best := bl.Max, -1
+	for prefix, n := range bl.Routes {
+		if strings.HasPrefix(path, prefix) && len(prefix) > best {
+			limit, best = n, len(prefix)
+		}
+	}
+	return limit
+}
+
+// Wrap returns next with limited request bodies.
+func (bl *BodyLimit) Wrap(next http.Handler) http.Handler {
+	decoders := map[string]Decoder{
+		"gzip": func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+		"x-gzip": func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+		"deflate": zlib.NewReader,
+	}
+	for name, dec := range bl.Decoders {
+		decoders[strings.ToLower(name)] = dec
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := bl.limit(r.URL.Path)
+		if limit > 0 && r.ContentLength > limit {
+			tooLarge(w)
+			return
+		}
+		lw := &limitWriter{ResponseWriter: w}
+		if limit > 0 {
+			r.Body = &limitReader{http.MaxBytesReader(w, r.Body, limit), lw}
+		}
+
+		if enc := strings.ToLower(r.Header.Get("Content-Encoding")); bl.Decompress && enc != "" && enc != "identity" {
+			dec := decoders[enc]
+			if dec == nil {
+				http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+				return
+			}
+			zr, err := dec(r.Body)
+			if err != nil {
+				if lw.exceeded {
+					tooLarge(w)
+				} else {
+					http.Error(w, "malformed request body", http.StatusBadRequest)
+				}
+				return
+			}
+			maxDecompressed := bl.MaxDecompressed
+			if maxDecompressed <= 0 {
+				maxDecompressed = limit
+			}
+			if maxDecompressed <= 0 {
+				maxDecompressed = 10 << 20
+			}
+			r.Body = &limitReader{&decodedBody{zr, r.Body, maxDecompressed}, lw}
+			r.Header.Del("Content-Encoding")
+			r.Header.Del("Content-Length")
+			r.ContentLength = -1
+		}
+		next.ServeHTTP(lw, r)
+	})
+}
+
+func tooLarge(w http.ResponseWriter) {
+	w.Header().Set("Connection", "close")
+	http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+}
+
+// limitReader notes when a body went over its limit.
+type limitReader struct {
+	io.ReadCloser
+	lw *limitWriter
+}
+
+func (lr *limitReader) Read(b []byte) (int, error) {
+	n, err := lr.ReadCloser.Read(b)
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) {
+		lr.lw.exceeded = true
+	}
+	return n, err
+}
+
+// decodedBody reads a decompressed request body, failing with a
+// MaxBytesError past max bytes.
+type decodedBody struct {
+	zr  io.ReadCloser
+	raw io.ReadCloser
+	max int64
+}
+
+func (db *decodedBody) Read(b []byte) (int, error) {
+	if db.max <= 0 {
+		// Check whether anything is left before reporting the overrun.
+		var one [1]byte
+		if n, err := db.zr.Read(one[:]); n == 0 {
+			return 0, err
+		}
+		return 0, &http.MaxBytesError{Limit: db.max}
+	}
+	if int64(len(b)) > db.max {
+		b = b[:db.max]
+	}
+	n, err := db.zr.Read(b)
+	db.max -= int64(n)
+	return n, err
+}
+
+func (db *decodedBody) Close() error {
+	return errors.Join(db.zr.Close(), db.raw.Close())
+}
+
+// limitWriter turns the response into a 413 if the handler failed because
+// the body was too large.
+type limitWriter struct {
+	http.ResponseWriter
+	exceeded    bool
+	wroteHeader bool
+}
+
+func (lw *limitWriter) WriteHeader(code int) {
+	if !lw.wroteHeader && code >= 200 {
+		lw.wroteHeader = true
+		if lw.exceeded && code >= 400 {
+			lw.Header().Set("Connection", "close")
+			code = http.StatusRequestEntityTooLarge
+		}
+	}
+	lw.ResponseWriter.WriteHeader(code)
+}
+
+func (lw *limitWriter) Write(b []byte) (int, error) {
+	if !lw.wroteHeader {
+		lw.WriteHeader(http.StatusOK)
+	}
+	return lw.ResponseWriter.Write(b)
+}
+
+func (lw *limitWriter) Flush() {
+	http.NewResponseController(lw.ResponseWriter).Flush()
+}
+
+func (lw *limitWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(lw.ResponseWriter).Hijack()
+}
+
+func (lw *limitWriter) Unwrap() http.ResponseWriter {
+	return lw.ResponseWriter
+}
@@ -0,0 +1,260 @@
+package gracefulserver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func gzipped(s string) string {
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	io.WriteString(zw, s)
+	zw.Close()
+	return b.String()
+}
+
+// readBody echoes the size of the request body, or fails as handlers do
+// when reading it fails.
+func readBody(w http.ResponseWriter, r *http.Request) {
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	io.WriteString(w, strconv.Itoa(len(b)))
+}
+
+func TestBodyLimit(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		bl       BodyLimit
+		path     string
+		body     string
+		encoding string
+		chunked  bool
+		status   int
+		want     string
+	}{
+		{
+			name:   "under limit",
+			bl:     BodyLimit{Max: 10},
+			body:   "0123456789",
+			status: http.StatusOK,
+			want:   "10",
+		},
+		{
+			name:   "content length over limit",
+			bl:     BodyLimit{Max: 10},
+			body:   "0123456789a",
+			status: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:    "chunked over limit",
+			bl:      BodyLimit{Max: 10},
+			body:    "0123456789a",
+			chunked: true,
+			status:  http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:   "no limit",
+			bl:     BodyLimit{},
+			body:   strings.Repeat("x", 1000),
+			status: http.StatusOK,
+			want:   "1000",
+		},
+		{
+			name:   "route raises limit",
+			bl:     BodyLimit{Max: 10, Routes: map[string]int64{"/upload/": 100}},
+			path:   "/upload/file",
+			body:   strings.Repeat("x", 50),
+			status: http.StatusOK,
+			want:   "50",
+		},
+		{
+			name:   "longest route wins",
+			bl:     BodyLimit{Max: 10, Routes: map[string]int64{"/upload/": 100, "/upload/small/": 5}},
+			path:   "/upload/small/file",
+			body:   "0123456789",
+			status: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:    "route without limit",
+			bl:      BodyLimit{Max: 10, Routes: map[string]int64{"/upload/": -1}},
+			path:    "/upload/file",
+			body:    strings.Repeat("x", 1000),
+			chunked: true,
+			status:  http.StatusOK,
+			want:    "1000",
+		},
+		{
+			name:    "other routes keep the limit",
+			bl:      BodyLimit{Max: 10, Routes: map[string]int64{"/upload/": -1}},
+			path:    "/api",
+			body:    strings.Repeat("x", 1000),
+			chunked: true,
+			status:  http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:     "gzip",
+			bl:       BodyLimit{Max: 1000, Decompress: true},
+			body:     gzipped(strings.Repeat("x", 500)),
+			encoding: "gzip",
+			status:   http.StatusOK,
+			want:     "500",
+		},
+		{
+			name:     "encoding left alone without Decompress",
+			bl:       BodyLimit{Max: 1000},
+			body:     gzipped(strings.Repeat("x", 500)),
+			encoding: "gzip",
+			status:   http.StatusOK,
+			want:     strconv.Itoa(len(gzipped(strings.Repeat("x", 500)))),
+		},
+		{
+			name:     "decompression bomb",
+			bl:       BodyLimit{Max: 1000, Decompress: true, MaxDecompressed: 4096},
+			body:     gzipped(strings.Repeat("x", 1<<20)),
+			encoding: "gzip",
+			status:   http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:     "decompressed exactly at limit",
+			bl:       BodyLimit{Max: 1000, Decompress: true, MaxDecompressed: 4096},
+			body:     gzipped(strings.Repeat("x", 4096)),
+			encoding: "gzip",
+			status:   http.StatusOK,
+			want:     "4096",
+		},
+		{
+			name:     "decompressed limit defaults to route limit",
+			bl:       BodyLimit{Max: 1000, Decompress: true},
+			body:     gzipped(strings.Repeat("x", 1001)),
+			encoding: "gzip",
+			status:   http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:     "compressed body over limit",
+			bl:       BodyLimit{Max: 10, Decompress: true},
+			body:     gzipped(strings.Repeat("x", 5)),
+			encoding: "gzip",
+			chunked:  true,
+			status:   http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:     "malformed",
+			bl:       BodyLimit{Max: 1000, Decompress: true},
+			body:     "not gzip",
+			encoding: "gzip",
+			status:   http.StatusBadRequest,
+		},
+		{
+			name:     "unknown encoding",
+			bl:       BodyLimit{Max: 1000, Decompress: true},
+			body:     "data",
+			encoding: "br",
+			status:   http.StatusUnsupportedMediaType,
+		},
+		{
+			name:     "identity",
+			bl:       BodyLimit{Max: 1000, Decompress: true},
+			body:     "data",
+			encoding: "identity",
+			status:   http.StatusOK,
+			want:     "4",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := tc.path
+			if path == "" {
+				path = "/"
+			}
+			r := httptest.NewRequest("POST", path, strings.NewReader(tc.body))
+			if tc.chunked {
+				r.ContentLength = -1
+			}
+			if tc.encoding != "" {
+				r.Header.Set("Content-Encoding", tc.encoding)
+			}
+			w := httptest.NewRecorder()
+			tc.bl.Wrap(http.HandlerFunc(readBody)).ServeHTTP(w, r)
+			if w.Code != tc.status {
+				t.Fatalf("got %d %q, want %d", w.Code, w.Body, tc.status)
+			}
+			if tc.want != "" && w.Body.String() != tc.want {
+				t.Fatalf("handler read %s bytes, want %s", w.Body, tc.want)
+			}
+			if tc.status == http.StatusRequestEntityTooLarge && w.Header().Get("Connection") != "close" {
+				t.Fatal("413 without Connection: close")
+			}
+		})
+	}
+}
+
+func TestBodyLimitHandlerStatus(t *testing.T) {
+	// Only failures are turned into a 413; a handler that copes with a
+	// short body keeps its own status.
+	for _, tc := range []struct {
+		name   string
+		code   int
+		status int
+	}{
+		{"error", http.StatusUnprocessableEntity, http.StatusRequestEntityTooLarge},
+		{"success", http.StatusAccepted, http.StatusAccepted},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := (&BodyLimit{Max: 4}).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.ReadAll(r.Body)
+				w.WriteHeader(tc.code)
+			}))
+			r := httptest.NewRequest("POST", "/", strings.NewReader("too long"))
+			r.ContentLength = -1
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tc.status {
+				t.Fatalf("got %d, want %d", w.Code, tc.status)
+			}
+		})
+	}
+}
+
+// TestCompressBodyLimitRoundTrip checks that what Compress encodes,
+// BodyLimit decodes.
+func TestCompressBodyLimitRoundTrip(t *testing.T) {
+	body := strings.Repeat("hello, world\n", 100)
+	for _, enc := range []string{"gzip", "deflate"} {
+		t.Run(enc, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("Accept-Encoding", enc)
+			(&Compress{}).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, body)
+			})).ServeHTTP(w, r)
+			if got := w.Header().Get("Content-Encoding"); got != enc {
+				t.Fatalf("Content-Encoding = %q, want %q", got, enc)
+			}
+
+			var got string
+			h := (&BodyLimit{Decompress: true}).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				b, err := io.ReadAll(r.Body)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				got = string(b)
+			}))
+			r = httptest.NewRequest("POST", "/", w.Body)
+			r.Header.Set("Content-Encoding", enc)
+			w = httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != http.StatusOK || got != body {
+				t.Fatalf("got %d %q, decoded %d bytes", w.Code, w.Body, len(got))
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package gracefulserver
+
+import (
+	"bufio"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// BodyCapture is middleware that records request and response bodies in
+// the request's Entry, for debugging. Bodies are copied as they stream
+// through, so only the first MaxSize bytes of each are kept and streaming
+// handlers work as usual. Add its Wrap method to Middleware to use it.
+type BodyCapture struct {
+	// MaxSize is the number of bytes kept of each body. It defaults to
+	// 4 KB.
+	MaxSize int
+	// Routes limits capture to request paths starting with a prefix.
+	Routes []string
+	// Header, if set, is a request header that turns on capture for a
+	// request regardless of Routes.
+	Header string
+	// ContentTypes limits capture to bodies with these media types, such
+	// as "application/json". Types ending in "/" match any subtype.
+	ContentTypes []string
+	// RedactBody, if set, redacts a captured body of the given content
+	// type. It defaults to Redact's Body method.
+	RedactBody func(contentType string, body []byte) []byte
+}
+
+func (bc *BodyCapture) match(r *http.Request) bool {
+	if bc.Header != "" && r.Header.Get(bc.Header) != "" {
+		return true
+	}
+	if len(bc.Routes) == 0 {
+		return bc.Header == ""
+	}
+	return slices.ContainsFunc(bc.Routes, func(prefix string) bool {
+		return strings.HasPrefix(r.URL.Path, prefix)
+	})
+}
+
+func (bc *BodyCapture) matchType(contentType string) bool {
+	if len(bc.ContentTypes) == 0 {
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return slices.ContainsFunc(bc.ContentTypes, func(t string) bool {
+		return mediaType == t || strings.HasSuffix(t, "/") && strings.HasPrefix(mediaType, t)
+	})
+}
+
+func (bc *BodyCapture) redact(contentType string, body []byte) []byte {
+	if bc.RedactBody != nil {
+		return bc.RedactBody(contentType, body)
+	}
+	if rd := Redact; rd != nil {
+		return rd.Body(contentType, body)
+	}
+	return body
+}
+
+// Wrap returns next with the bodies of matching requests captured.
+func (bc *BodyCapture) Wrap(next http.Handler) http.Handler {
+	maxSize := bc.MaxSize
+	if maxSize <= 0 {
+		maxSize = 4 << 10
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e := EntryFromContext(r.Context())
+		if e == nil || !bc.match(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var req *captureBody
+		if r.Body != nil && r.Body != http.NoBody && bc.matchType(r.Header.Get("Content-Type")) {
+			req = &captureBody{ReadCloser: r.Body, max: maxSize}
+			r.Body = req
+		}
+		cw := &captureWriter{ResponseWriter: w, max: maxSize}
+		defer func() {
+			if req != nil && len(req.buf) > 0 {
+				e.RequestBody = string(bc.redact(r.Header.Get("Content-Type"), req.buf))
+			}
+			if ct := w.Header().Get("Content-Type"); len(cw.buf) > 0 && bc.matchType(ct) {
+				e.ResponseBody = string(bc.redact(ct, cw.buf))
+			}
+		}()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// captureBody keeps the first max bytes read from a request body.
+type captureBody struct {
+	io.ReadCloser
+	buf []byte
+	max int
+}
+
+func (cb *captureBody) Read(b []byte) (int, error) {
+	n, err := cb.ReadCloser.Read(b)
+	if room := cb.max - len(cb.buf); room > 0 {
+		cb.buf = append(cb.buf, b[:min(n, room)]...)
+	}
+	return n, err
+}
+
+// captureWriter keeps the first max bytes of a response body.
+type captureWriter struct {
+	http.ResponseWriter
+	buf []byte
+	max int
+}
+
+func (cw *captureWriter) Write(b []byte) (int, error) {
+	n, err := cw.ResponseWriter.Write(b)
+	if room := cw.max - len(cw.buf); room > 0 {
+		cw.buf = append(cw.buf, b[:min(n, room)]...)
+	}
+	return n, err
+}
+
+func (cw *captureWriter) Flush() {
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+func (cw *captureWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(cw.ResponseWriter).Hijack()
+}
+
+func (cw *captureWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// jsonMember matches a JSON object member with a string or other scalar
+// value. A string that runs to the end of the body, as in one cut short,
+// counts as a value too.
+var jsonMember = regexp.MustCompile(`"((?:[^"\\]|\\.)*)"(\s*:\s*)(?:"(?:[^"\\]|\\.)*(?:"|\\?$)|[^\s,:"{}\[\]]+)`)
+
+// Body returns body with the values of sensitive form fields or JSON
+// members redacted, matched like query parameters. JSON values other than
+// strings are replaced too, as is a string cut off where the body was cut
+// short. Other content types are returned as they are.
+func (rd *Redactor) Body(contentType string, body []byte) []byte {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "application/x-www-form-urlencoded":
+		if q, ok := rd.query(string(body)); ok {
+			return []byte(q)
+		}
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		return jsonMember.ReplaceAllFunc(body, func(m []byte) []byte {
+			sub := jsonMember.FindSubmatch(m)
+			if !rd.matchName(string(sub[1]), rd.QueryParams) {
+				return m
+			}
+			return []byte(`"` + string(sub[1]) + `"` + string(sub[2]) + `"` + rd.replacement() + `"`)
+		})
+	}
+	return body
+}
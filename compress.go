@@ -0,0 +1,281 @@
+package gracefulserver
+
+import (
+	"bufio"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Encoder returns a writer that compresses into w. Writers that have a
+// Flush() error method can be used with streaming responses.
+type Encoder func(w io.Writer) (io.WriteCloser, error)
+
+// Compress is middleware that compresses responses according to the
+// client's Accept-Encoding. Gzip and deflate are built in; other encodings
+// such as zstd and br can be added through Encoders. Add its Wrap method to
+// Middleware to use it.
+type Compress struct {
+	// MinSize is the smallest response body, in bytes, worth compressing.
+	// It defaults to 1024.
+	MinSize int
+	// ContentTypes are the media types to compress. An entry ending in "/"
+	// matches every subtype. It defaults to DefaultCompressTypes.
+	ContentTypes []string
+	// Level is the gzip and deflate compression level. Zero means
+	// gzip.DefaultCompression.
+	Level int
+	// Encoders adds or replaces encoders by content coding name, e.g. "zstd"
+	// or "br".
+	Encoders map[string]Encoder
+	// Preference orders encodings the client accepts equally. It defaults
+	// to zstd, br, gzip, deflate.
+	Preference []string
+}
+
+// DefaultCompressTypes are the media types Compress compresses by default.
+var DefaultCompressTypes = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/wasm",
+	"image/svg+xml",
+}
+
+// Wrap returns next with compressed responses.
+func (c *Compress) Wrap(next http.Handler) http.Handler {
+	level := c.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	encoders := map[string]Encoder{
+		"gzip": func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriterLevel(w, level)
+		},
+		"deflate": func(w io.Writer) (io.WriteCloser, error) {
+			return zlib.NewWriterLevel(w, level)
+		},
+	}
+	for name, enc := range c.Encoders {
+		encoders[strings.ToLower(name)] = enc
+	}
+	pref := c.Preference
+	if pref == nil {
+		pref = []string{"zstd", "br", "gzip", "deflate"}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		enc := negotiateEncoding(r.Header.Get("Accept-Encoding"), pref, func(name string) bool {
+			return encoders[name] != nil
+		})
+		if r.Method == http.MethodHead {
+			enc = ""
+		}
+		cw := &compressWriter{
+			ResponseWriter: w,
+			c:              c,
+			name:           enc,
+			encoder:        encoders[enc],
+			entry:          EntryFromContext(r.Context()),
+		}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// negotiateEncoding picks the available encoding with the highest q-value,
+// breaking ties by pref. It returns "" for identity.
+func negotiateEncoding(accept string, pref []string, available func(name string) bool) string {
+	q := make(map[string]float64)
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		weight := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				weight = f
+			}
+		}
+		if name != "" {
+			q[name] = weight
+		}
+	}
+	best, bestQ := "", 0.0
+	for _, name := range pref {
+		if !available(name) {
+			continue
+		}
+		w, ok := q[name]
+		if !ok {
+			w = q["*"]
+		}
+		if w > bestQ {
+			best, bestQ = name, w
+		}
+	}
+	return best
+}
+
+func (c *Compress) minSize() int {
+	if c.MinSize <= 0 {
+		return 1024
+	}
+	return c.MinSize
+}
+
+func (c *Compress) compressible(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	types := c.ContentTypes
+	if types == nil {
+		types = DefaultCompressTypes
+	}
+	for _, t := range types {
+		if mt == t || strings.HasSuffix(t, "/") && strings.HasPrefix(mt, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressWriter buffers the start of a response until it can decide
+// whether to compress it.
+type compressWriter struct {
+	http.ResponseWriter
+	c       *Compress
+	name    string
+	encoder Encoder
+	entry   *Entry
+
+	status  int
+	decided bool
+	buf     []byte
+	zw      io.WriteCloser
+	written int64
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if code < 200 && code != http.StatusSwitchingProtocols {
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if cw.status == 0 {
+		cw.status = code
+	}
+	if code >= 300 || code == http.StatusNoContent || code == http.StatusSwitchingProtocols ||
+		cw.Header().Get("Content-Length") != "" {
+		cw.decide()
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	cw.written += int64(len(b))
+	if !cw.decided {
+		cw.buf = append(cw.buf, b...)
+		if len(cw.buf) >= cw.c.minSize() {
+			cw.decide()
+		}
+		return len(b), nil
+	}
+	if cw.zw != nil {
+		return cw.zw.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// decide sends the headers, starting compression if the response
+// qualifies, and writes out anything buffered.
+func (cw *compressWriter) decide() {
+	if cw.decided {
+		return
+	}
+	cw.decided = true
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	h := cw.Header()
+	if ct := h.Get("Content-Type"); ct == "" && len(cw.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+	eligible := cw.status == http.StatusOK &&
+		h.Get("Content-Encoding") == "" &&
+		h.Get("Content-Range") == "" &&
+		cw.c.compressible(h.Get("Content-Type"))
+	if eligible {
+		h.Add("Vary", "Accept-Encoding")
+	}
+	if cl, err := strconv.Atoi(h.Get("Content-Length")); err == nil {
+		eligible = eligible && cl >= cw.c.minSize()
+	}
+	if eligible && cw.encoder != nil {
+		if zw, err := cw.encoder(cw.ResponseWriter); err == nil {
+			cw.zw = zw
+			h.Set("Content-Encoding", cw.name)
+			h.Del("Content-Length")
+			h.Del("Accept-Ranges")
+			if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+				// The compressed body is no longer byte for byte the same.
+				h.Set("ETag", "W/"+etag)
+			}
+		}
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+	if len(cw.buf) > 0 {
+		buf := cw.buf
+		cw.buf = nil
+		if cw.zw != nil {
+			cw.zw.Write(buf)
+		} else {
+			cw.ResponseWriter.Write(buf)
+		}
+	}
+}
+
+func (cw *compressWriter) Flush() {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	cw.decide()
+	if f, ok := cw.zw.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	cw.decided = true
+	return http.NewResponseController(cw.ResponseWriter).Hijack()
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+func (cw *compressWriter) close() {
+	if cw.status == 0 {
+		// The handler wrote nothing; let net/http send its default.
+		return
+	}
+	if len(cw.buf) > 0 {
+		// A short body: don't compress it, but send it with its length.
+		cw.Header().Set("Content-Length", strconv.Itoa(len(cw.buf)))
+	}
+	cw.decide()
+	if cw.zw != nil {
+		cw.zw.Close()
+		if cw.entry != nil {
+			cw.entry.Encoding = cw.name
+			cw.entry.UncompressedBytes = cw.written
+		}
+	}
+}
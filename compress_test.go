@@ -0,0 +1,229 @@
+package gracefulserver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	long := strings.Repeat("hello, world\n", 100)
+	for _, tc := range []struct {
+		name     string
+		method   string
+		accept   string
+		handler  http.HandlerFunc
+		encoding string
+		length   string
+		etag     string
+		vary     bool
+	}{
+		{
+			name:   "long body",
+			accept: "gzip",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, long)
+			},
+			encoding: "gzip",
+			vary:     true,
+		},
+		{
+			name:   "short body",
+			accept: "gzip",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, "hello")
+			},
+			length: "5",
+			vary:   true,
+		},
+		{
+			name:   "short body in pieces",
+			accept: "gzip",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, "hel")
+				io.WriteString(w, "lo")
+			},
+			length: "5",
+			vary:   true,
+		},
+		{
+			name:   "short content length",
+			accept: "gzip",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Length", "5")
+				io.WriteString(w, "hello")
+			},
+			length: "5",
+			vary:   true,
+		},
+		{
+			name:   "long content length",
+			accept: "gzip",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Length", strconv.Itoa(len(long)))
+				io.WriteString(w, long)
+			},
+			encoding: "gzip",
+			vary:     true,
+		},
+		{
+			name:   "strong etag weakened",
+			accept: "gzip",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("ETag", `"abc"`)
+				io.WriteString(w, long)
+			},
+			encoding: "gzip",
+			etag:     `W/"abc"`,
+			vary:     true,
+		},
+		{
+			name:   "weak etag kept",
+			accept: "gzip",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("ETag", `W/"abc"`)
+				io.WriteString(w, long)
+			},
+			encoding: "gzip",
+			etag:     `W/"abc"`,
+			vary:     true,
+		},
+		{
+			name:   "etag of uncompressed body kept",
+			accept: "",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("ETag", `"abc"`)
+				io.WriteString(w, long)
+			},
+			etag: `"abc"`,
+			vary: true,
+		},
+		{
+			name:   "deflate",
+			accept: "gzip;q=0.5, deflate",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, long)
+			},
+			encoding: "deflate",
+			vary:     true,
+		},
+		{
+			name:   "incompressible type",
+			accept: "gzip",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "image/png")
+				io.WriteString(w, long)
+			},
+		},
+		{
+			name:   "already encoded",
+			accept: "gzip",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Header().Set("Content-Encoding", "br")
+				io.WriteString(w, long)
+			},
+			encoding: "br",
+		},
+		{
+			name:   "error status",
+			accept: "gzip",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusInternalServerError)
+				io.WriteString(w, long)
+			},
+		},
+		{
+			name:   "head",
+			method: http.MethodHead,
+			accept: "gzip",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, long)
+			},
+			vary: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := (&Compress{}).Wrap(tc.handler)
+			r := httptest.NewRequest(tc.method, "/", nil)
+			r.Header.Set("Accept-Encoding", tc.accept)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			res := w.Result()
+			if got := res.Header.Get("Content-Encoding"); got != tc.encoding {
+				t.Errorf("Content-Encoding = %q, want %q", got, tc.encoding)
+			}
+			if got := res.Header.Get("Content-Length"); got != tc.length {
+				t.Errorf("Content-Length = %q, want %q", got, tc.length)
+			}
+			if got := res.Header.Get("ETag"); got != tc.etag {
+				t.Errorf("ETag = %q, want %q", got, tc.etag)
+			}
+			if got := res.Header.Get("Vary") == "Accept-Encoding"; got != tc.vary {
+				t.Errorf("Vary = %q, want Accept-Encoding: %v", res.Header.Get("Vary"), tc.vary)
+			}
+			var zr io.Reader
+			var err error
+			switch tc.encoding {
+			case "gzip":
+				zr, err = gzip.NewReader(res.Body)
+			case "deflate":
+				zr, err = zlib.NewReader(res.Body)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if zr != nil {
+				if b, err := io.ReadAll(zr); err != nil || string(b) != long {
+					t.Fatalf("decoded %d bytes, err %v", len(b), err)
+				}
+			}
+		})
+	}
+}
+
+func TestCompressFlush(t *testing.T) {
+	w := httptest.NewRecorder()
+	var flushed []byte
+	h := (&Compress{}).Wrap(http.HandlerFunc(func(cw http.ResponseWriter, r *http.Request) {
+		cw.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(cw, "data: one\n\n")
+		http.NewResponseController(cw).Flush()
+		flushed = bytes.Clone(w.Body.Bytes())
+		io.WriteString(cw, "data: two\n\n")
+	}))
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	h.ServeHTTP(w, r)
+
+	if !w.Flushed {
+		t.Fatal("response was not flushed")
+	}
+	if got := w.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", got)
+	}
+	// The bytes flushed mid-stream must decode to the first event on
+	// their own, though the gzip stream is unfinished.
+	zr, err := gzip.NewReader(bytes.NewReader(flushed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 64)
+	n, _ := io.ReadAtLeast(zr, b, len("data: one\n\n"))
+	if got := string(b[:n]); got != "data: one\n\n" {
+		t.Fatalf("flushed %q, want the first event", got)
+	}
+	zr, err = gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all, err := io.ReadAll(zr); err != nil || string(all) != "data: one\n\ndata: two\n\n" {
+		t.Fatalf("got %q, %v", all, err)
+	}
+}
@@ -0,0 +1,119 @@
+package gracefulserver
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORS is middleware that implements Cross-Origin Resource Sharing.
+// Preflight requests are answered directly and don't reach the wrapped
+// handler. Add its Wrap method to Middleware to use it.
+type CORS struct {
+	// AllowedOrigins are origins such as "https://example.com". An entry
+	// may contain one "*" as a wildcard, as in "https://*.example.com", and
+	// "*" alone allows every origin.
+	AllowedOrigins []string
+	// AllowOrigin, if set, is consulted for origins not in AllowedOrigins.
+	AllowOrigin func(origin string, r *http.Request) bool
+	// AllowedMethods defaults to GET, HEAD and POST.
+	AllowedMethods []string
+	// AllowedHeaders are the request headers clients may send. "*" allows
+	// any header.
+	AllowedHeaders []string
+	// ExposedHeaders are the response headers clients may read.
+	ExposedHeaders []string
+	// AllowCredentials allows cookies and HTTP authentication. It can't be
+	// combined with "*" in AllowedOrigins, since that would let every site
+	// make requests with the user's credentials.
+	AllowCredentials bool
+	// MaxAge is how long browsers may cache preflight results. Zero leaves
+	// it to the browser.
+	MaxAge time.Duration
+}
+
+func (c *CORS) allowed(origin string, r *http.Request) bool {
+	for _, o := range c.AllowedOrigins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+		if prefix, suffix, ok := strings.Cut(o, "*"); ok &&
+			len(origin) > len(prefix)+len(suffix) &&
+			strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) {
+			return true
+		}
+	}
+	return c.AllowOrigin != nil && c.AllowOrigin(origin, r)
+}
+
+// Wrap returns next with CORS headers and preflight handling. It panics if
+// AllowCredentials is set along with a "*" origin.
+func (c *CORS) Wrap(next http.Handler) http.Handler {
+	if c.AllowCredentials && slices.Contains(c.AllowedOrigins, "*") {
+		panic(`gracefulserver: CORS AllowCredentials with AllowedOrigins "*" lets any site make credentialed requests`)
+	}
+	methods := c.AllowedMethods
+	if len(methods) == 0 {
+		methods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+	}
+	allowMethods := strings.Join(methods, ", ")
+	allowHeaders := strings.Join(c.AllowedHeaders, ", ")
+	anyHeader := allowHeaders == "*"
+	exposeHeaders := strings.Join(c.ExposedHeaders, ", ")
+	anyOrigin := len(c.AllowedOrigins) == 1 && c.AllowedOrigins[0] == "*" &&
+		c.AllowOrigin == nil
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == http.MethodOptions &&
+			r.Header.Get("Access-Control-Request-Method") != ""
+		if !anyOrigin {
+			// The response depends on Origin even when it is refused.
+			h.Add("Vary", "Origin")
+		}
+		if preflight {
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+		}
+		if origin == "" || !c.allowed(origin, r) {
+			if preflight {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if anyOrigin {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+		if c.AllowCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+		if !preflight {
+			if exposeHeaders != "" {
+				h.Set("Access-Control-Expose-Headers", exposeHeaders)
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h.Set("Access-Control-Allow-Methods", allowMethods)
+		if anyHeader {
+			// Credentialed requests don't honor "*", so echo what was asked for.
+			if reqHeaders := r.Header.Get("Access-Control-Request-Headers"); reqHeaders != "" {
+				h.Set("Access-Control-Allow-Headers", reqHeaders)
+			}
+		} else if allowHeaders != "" {
+			h.Set("Access-Control-Allow-Headers", allowHeaders)
+		}
+		if c.MaxAge > 0 {
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge.Seconds())))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
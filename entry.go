@@ -0,0 +1,170 @@
+package gracefulserver
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Entry is the access log record Logger keeps for a request. Middleware and
+// handlers can add to it through EntryFromContext before it is logged.
+type Entry struct {
+	URL *url.URL
+	// Route is the ServeMux pattern that matched the request, as set by
+	// RouteLabels once the request is routed, or else URL's path as
+	// normalized by RouteNormalizer. Unlike URL it is suitable as a
+	// metrics label.
+	Route     string
+	UserAgent string
+	Duration  time.Duration
+	// Status is the response status code.
+	Status int
+	// Bytes is the number of response body bytes sent to the client.
+	Bytes int64
+	// BytesRead is the number of request body bytes read by the handler.
+	BytesRead int64
+	// ClientIP is the client address resolved by RealIP, if used.
+	ClientIP string
+	// Encoding is the content coding applied by Compress, if any, and
+	// UncompressedBytes is the size of the body before it.
+	Encoding          string
+	UncompressedBytes int64
+	// TimedOut is set when HandlerTimeout cut the handler off.
+	TimedOut bool
+	// Fault describes the fault FaultInjector injected, if any.
+	Fault string
+	// Slow is set when the request ran past SlowThreshold.
+	Slow bool
+	// RequestBody and ResponseBody are the start of the bodies recorded
+	// by BodyCapture, if used.
+	RequestBody, ResponseBody string
+}
+
+// String formats e as a log line.
+func (e *Entry) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Served %s for %q in %v", e.URL, e.UserAgent, e.Duration)
+	fmt.Fprintf(&sb, " status=%d bytes=%d", e.Status, e.Bytes)
+	if e.Route != "" {
+		fmt.Fprintf(&sb, " route=%q", e.Route)
+	}
+	if e.BytesRead > 0 {
+		fmt.Fprintf(&sb, " read=%d", e.BytesRead)
+	}
+	if e.ClientIP != "" {
+		fmt.Fprintf(&sb, " client=%s", e.ClientIP)
+	}
+	if e.Encoding != "" {
+		fmt.Fprintf(&sb, " encoding=%s uncompressed=%d", e.Encoding, e.UncompressedBytes)
+	}
+	if e.TimedOut {
+		sb.WriteString(" timeout=true")
+	}
+	if e.Slow {
+		sb.WriteString(" slow=true")
+	}
+	if e.Fault != "" {
+		fmt.Fprintf(&sb, " fault=%s", e.Fault)
+	}
+	if e.RequestBody != "" {
+		fmt.Fprintf(&sb, " request_body=%q", e.RequestBody)
+	}
+	if e.ResponseBody != "" {
+		fmt.Fprintf(&sb, " response_body=%q", e.ResponseBody)
+	}
+	return sb.String()
+}
+
+// AccessLogger receives the entries Logger produces. If it also has a
+// Flush() error method, Serve calls it before returning, and if it has a
+// Reopen() error method, Serve calls it on ReloadSignals.
+type AccessLogger interface {
+	LogAccess(e *Entry)
+}
+
+// AccessLog, if set, receives access log entries instead of the standard
+// logger. Entries are only produced when LogLevel allows info messages
+// and AccessLogSampling, if set, selects them, and are redacted by Redact
+// first.
+var AccessLog AccessLogger
+
+func logAccess(e *Entry) {
+	if LogLevel.Level() > slog.LevelInfo {
+		return
+	}
+	if ls := AccessLogSampling; ls != nil && !ls.sample(e) {
+		return
+	}
+	e.URL = redactURL(e.URL)
+	if e.Route == "" && RouteNormalizer != nil {
+		e.Route = RouteNormalizer(e.URL.Path)
+	}
+	if al := AccessLog; al != nil {
+		al.LogAccess(e)
+		return
+	}
+	infof("%v", e)
+}
+
+type entryKey struct{}
+
+// EntryFromContext returns the Entry for the request, or nil if the request
+// did not pass through Logger.
+func EntryFromContext(ctx context.Context) *Entry {
+	e, _ := ctx.Value(entryKey{}).(*Entry)
+	return e
+}
+
+// responseWriter records the status and size of a response in its Entry.
+type responseWriter struct {
+	http.ResponseWriter
+	e *Entry
+}
+
+func (rw *responseWriter) WriteHeader(code int) {
+	// Informational responses may precede the final status.
+	if rw.e.Status == 0 && (code >= 200 || code == http.StatusSwitchingProtocols) {
+		rw.e.Status = code
+	}
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	if rw.e.Status == 0 {
+		rw.e.Status = http.StatusOK
+	}
+	n, err := rw.ResponseWriter.Write(b)
+	rw.e.Bytes += int64(n)
+	return n, err
+}
+
+func (rw *responseWriter) Flush() {
+	http.NewResponseController(rw.ResponseWriter).Flush()
+}
+
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(rw.ResponseWriter).Hijack()
+}
+
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// countingBody records how much of a request body is read in its Entry.
+type countingBody struct {
+	io.ReadCloser
+	e *Entry
+}
+
+func (cb *countingBody) Read(b []byte) (int, error) {
+	n, err := cb.ReadCloser.Read(b)
+	cb.e.BytesRead += int64(n)
+	return n, err
+}
@@ -0,0 +1,45 @@
+package gracefulserver
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// EventType is a kind of lifecycle event.
+type EventType string
+
+// The lifecycle events Serve reports.
+const (
+	EventListening    EventType = "listening"
+	EventReloaded     EventType = "reloaded"
+	EventShuttingDown EventType = "shutting down"
+	EventStopping     EventType = "stopping"
+	EventFinished     EventType = "finished"
+	EventTimedOut     EventType = "timed out"
+	EventStopped      EventType = "stopped"
+)
+
+// Event is a lifecycle event of Serve, such as a listener starting or the
+// server shutting down.
+type Event struct {
+	Type    EventType
+	Message string
+	Time    time.Time
+}
+
+// OnEvent, if set, is called with each lifecycle event after it is
+// logged.
+var OnEvent func(Event)
+
+func event(typ EventType, format string, v ...any) {
+	level := slog.LevelInfo
+	if typ == EventTimedOut {
+		level = slog.LevelWarn
+	}
+	msg := fmt.Sprintf(format, v...)
+	logf(level, "%s", msg)
+	if f := OnEvent; f != nil {
+		f(Event{Type: typ, Message: msg, Time: time.Now()})
+	}
+}
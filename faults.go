@@ -0,0 +1,243 @@
+package gracefulserver
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FaultInjector is middleware that injects faults into responses to test
+// how clients handle them: added latency, error statuses, connection
+// resets and truncated bodies. Faults are chosen by Rules or requested by
+// clients through Header, and only while the injector is enabled. Injected
+// faults are recorded in the request's Entry.
+//
+// It is best placed first in Middleware. To toggle it at runtime, mount it
+// on the admin listener:
+//
+//	gracefulserver.AdminMux.Handle("/debug/faults", faults)
+//
+// where GET reports its state and PUT or POST with "on" or "off" changes it.
+type FaultInjector struct {
+	// Enabled is the initial state of the injector.
+	Enabled bool
+	// Rules are checked in order; the first to match a request is applied.
+	Rules []FaultRule
+	// Header, if set, is a request header that triggers faults, with
+	// comma separated values such as "latency=200ms", "status=503",
+	// "reset" and "truncate=100".
+	Header string
+	// MaxLatency caps the latency clients can request through Header. It
+	// defaults to 10 seconds.
+	MaxLatency time.Duration
+
+	once    sync.Once
+	enabled atomic.Bool
+}
+
+// FaultRule describes faults injected into a share of requests.
+type FaultRule struct {
+	// PathPrefix limits the rule to request paths starting with it.
+	PathPrefix string
+	// Probability is the chance from 0 to 1 that the rule applies.
+	Probability float64
+	// Latency is added before the request is handled.
+	Latency time.Duration
+	// Status, if set, is sent instead of calling the handler.
+	Status int
+	// Reset closes the connection without a response.
+	Reset bool
+	// Truncate, if positive, cuts the response body off after that many
+	// bytes and aborts the connection.
+	Truncate int
+}
+
+func (fi *FaultInjector) init() {
+	fi.once.Do(func() { fi.enabled.Store(fi.Enabled) })
+}
+
+// SetEnabled turns fault injection on or off.
+func (fi *FaultInjector) SetEnabled(on bool) {
+	fi.init()
+	fi.enabled.Store(on)
+}
+
+// ServeHTTP reports or changes whether fault injection is enabled.
+func (fi *FaultInjector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fi.init()
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPut, http.MethodPost:
+		b, _ := io.ReadAll(io.LimitReader(r.Body, 16))
+		switch strings.TrimSpace(string(b)) {
+		case "on", "true":
+			fi.enabled.Store(true)
+		case "off", "false":
+			fi.enabled.Store(false)
+		default:
+			http.Error(w, `want "on" or "off"`, http.StatusBadRequest)
+			return
+		}
+		warnf("Fault injection set to %v by %s", fi.enabled.Load(), r.RemoteAddr)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, map[string]any{"enabled": fi.enabled.Load(), "rules": fi.Rules})
+}
+
+// fault picks the fault for r, if any.
+func (fi *FaultInjector) fault(r *http.Request) (FaultRule, bool) {
+	if fi.Header != "" {
+		if v := r.Header.Get(fi.Header); v != "" {
+			rule := parseFault(v)
+			maxLatency := fi.MaxLatency
+			if maxLatency <= 0 {
+				maxLatency = 10 * time.Second
+			}
+			rule.Latency = min(rule.Latency, maxLatency)
+			return rule, true
+		}
+	}
+	for _, rule := range fi.Rules {
+		if strings.HasPrefix(r.URL.Path, rule.PathPrefix) && rand.Float64() < rule.Probability {
+			return rule, true
+		}
+	}
+	return FaultRule{}, false
+}
+
+func parseFault(v string) FaultRule {
+	var rule FaultRule
+	for _, part := range strings.Split(v, ",") {
+		k, val, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch k {
+		case "latency":
+			rule.Latency, _ = time.ParseDuration(val)
+		case "status":
+			rule.Status, _ = strconv.Atoi(val)
+		case "reset":
+			rule.Reset = true
+		case "truncate":
+			rule.Truncate, _ = strconv.Atoi(val)
+		}
+	}
+	return rule
+}
+
+func (rule FaultRule) String() string {
+	var parts []string
+	if rule.Latency > 0 {
+		parts = append(parts, "latency="+rule.Latency.String())
+	}
+	if rule.Status != 0 {
+		parts = append(parts, "status="+strconv.Itoa(rule.Status))
+	}
+	if rule.Reset {
+		parts = append(parts, "reset")
+	}
+	if rule.Truncate > 0 {
+		parts = append(parts, "truncate="+strconv.Itoa(rule.Truncate))
+	}
+	return strings.Join(parts, ",")
+}
+
+// Wrap returns next with faults injected while enabled.
+func (fi *FaultInjector) Wrap(next http.Handler) http.Handler {
+	fi.init()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !fi.enabled.Load() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rule, ok := fi.fault(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if e := EntryFromContext(r.Context()); e != nil {
+			e.Fault = rule.String()
+		}
+		if rule.Latency > 0 {
+			t := time.NewTimer(rule.Latency)
+			select {
+			case <-t.C:
+			case <-r.Context().Done():
+				t.Stop()
+				return
+			}
+		}
+		switch {
+		case rule.Reset:
+			resetConn(w)
+		case rule.Status != 0:
+			http.Error(w, fmt.Sprintf("%s (injected fault)", http.StatusText(rule.Status)), rule.Status)
+		case rule.Truncate > 0:
+			next.ServeHTTP(&truncateWriter{ResponseWriter: w, left: rule.Truncate}, r)
+			http.NewResponseController(w).Flush()
+			panic(http.ErrAbortHandler)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// resetConn closes the client connection with a TCP reset, or resets the
+// stream if the connection can't be taken over, as with HTTP/2.
+func resetConn(w http.ResponseWriter) {
+	conn, _, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	if tc := tcpConn(conn); tc != nil {
+		tc.SetLinger(0)
+	}
+	conn.Close()
+}
+
+// tcpConn finds the TCP connection under TLS and PROXY protocol wrappers.
+func tcpConn(c net.Conn) *net.TCPConn {
+	for {
+		switch cc := c.(type) {
+		case *net.TCPConn:
+			return cc
+		case *tls.Conn:
+			c = cc.NetConn()
+		case *proxyConn:
+			c = cc.Conn
+		default:
+			return nil
+		}
+	}
+}
+
+// truncateWriter drops everything written after its first left bytes.
+type truncateWriter struct {
+	http.ResponseWriter
+	left int
+}
+
+func (tw *truncateWriter) Write(b []byte) (int, error) {
+	n := min(len(b), tw.left)
+	if n > 0 {
+		tw.left -= n
+		if _, err := tw.ResponseWriter.Write(b[:n]); err != nil {
+			return 0, err
+		}
+	}
+	// Claim success so the handler carries on as it would in production.
+	return len(b), nil
+}
+
+func (tw *truncateWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
@@ -0,0 +1,272 @@
+// Package gracefulservertest runs the server configured in gracefulserver
+// in process for tests.
+//
+// Servers share gracefulserver's package level configuration, so tests
+// that use them must not run in parallel.
+package gracefulservertest
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/earthboundkid/gracefulserver"
+)
+
+// Server is a running gracefulserver with its access log and lifecycle
+// events captured.
+type Server struct {
+	// URL is the base URL of the server, such as http://127.0.0.1:54321.
+	URL string
+
+	t      testing.TB
+	cancel context.CancelCauseFunc
+	done   chan struct{}
+	err    error
+
+	prevAccessLog    gracefulserver.AccessLogger
+	prevOnEvent      func(gracefulserver.Event)
+	prevRedirectAddr string
+	prevLogger       func(http.Handler) http.Handler
+
+	mu       sync.Mutex
+	drained  sync.Cond
+	inflight int
+	entries  []gracefulserver.Entry
+	events   []gracefulserver.Event
+}
+
+// Start serves handler with the full gracefulserver configuration,
+// including Middleware and Logger, on an ephemeral localhost port, without
+// the listener that redirects plain HTTP when TLS is enabled. The
+// server is stopped when the test ends if it is still running.
+func Start(t testing.TB, handler http.Handler) *Server {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("gracefulservertest: listen: %v", err)
+	}
+	s := &Server{
+		URL:              "http://" + ln.Addr().String(),
+		t:                t,
+		done:             make(chan struct{}),
+		prevAccessLog:    gracefulserver.AccessLog,
+		prevOnEvent:      gracefulserver.OnEvent,
+		prevRedirectAddr: gracefulserver.RedirectAddr,
+		prevLogger:       gracefulserver.Logger,
+	}
+	s.drained.L = &s.mu
+	if gracefulserver.CertFile != "" && gracefulserver.KeyFile != "" {
+		s.URL = "https://" + ln.Addr().String()
+	}
+	gracefulserver.AccessLog = s
+	gracefulserver.OnEvent = s.onEvent
+	// Don't try to take port 80 for redirects from HTTP.
+	gracefulserver.RedirectAddr = ""
+	gracefulserver.Logger = s.logger
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	s.cancel = cancel
+	started := make(chan struct{})
+	go func() {
+		defer close(s.done)
+		defer s.restore()
+		s.err = gracefulserver.ServeListener(ctx, &notifyListener{ln, started}, handler)
+	}()
+	select {
+	case <-started:
+	case <-s.done:
+		t.Fatalf("gracefulservertest: server did not start: %v", s.err)
+	}
+	t.Cleanup(func() {
+		select {
+		case <-s.done:
+		default:
+			s.Kill()
+		}
+	})
+	return s
+}
+
+// notifyListener closes started when the server first calls Accept, so
+// Start returns once requests can be served.
+type notifyListener struct {
+	net.Listener
+	started chan struct{}
+}
+
+func (nl *notifyListener) Accept() (net.Conn, error) {
+	if nl.started != nil {
+		close(nl.started)
+		nl.started = nil
+	}
+	return nl.Listener.Accept()
+}
+
+// logger wraps Logger to count the requests in flight, including Logger's
+// own logging once the handler returns.
+func (s *Server) logger(next http.Handler) http.Handler {
+	h := s.prevLogger(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.inflight++
+		s.mu.Unlock()
+		defer func() {
+			s.mu.Lock()
+			s.inflight--
+			if s.inflight == 0 {
+				s.drained.Broadcast()
+			}
+			s.mu.Unlock()
+		}()
+		h.ServeHTTP(w, r)
+	})
+}
+
+// restore puts back the configuration Start replaced. Handlers may still
+// be running after a Kill, and they read it when they log, so it waits for
+// them first.
+func (s *Server) restore() {
+	s.mu.Lock()
+	for s.inflight > 0 {
+		s.drained.Wait()
+	}
+	s.mu.Unlock()
+	gracefulserver.Logger = s.prevLogger
+	gracefulserver.AccessLog = s.prevAccessLog
+	gracefulserver.OnEvent = s.prevOnEvent
+	gracefulserver.RedirectAddr = s.prevRedirectAddr
+}
+
+// LogAccess implements gracefulserver.AccessLogger.
+func (s *Server) LogAccess(e *gracefulserver.Entry) {
+	s.mu.Lock()
+	s.entries = append(s.entries, *e)
+	s.mu.Unlock()
+	if s.prevAccessLog != nil {
+		s.prevAccessLog.LogAccess(e)
+	} else {
+		s.t.Log(e)
+	}
+}
+
+// Flush flushes the access logger the server replaced, if it can be, as
+// gracefulserver does on shutdown.
+func (s *Server) Flush() error {
+	if f, ok := s.prevAccessLog.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// Reopen reopens the access logger the server replaced, if it can be, as
+// gracefulserver does on reload.
+func (s *Server) Reopen() error {
+	if r, ok := s.prevAccessLog.(interface{ Reopen() error }); ok {
+		return r.Reopen()
+	}
+	return nil
+}
+
+func (s *Server) onEvent(ev gracefulserver.Event) {
+	s.mu.Lock()
+	s.events = append(s.events, ev)
+	s.mu.Unlock()
+	if s.prevOnEvent != nil {
+		s.prevOnEvent(ev)
+	}
+}
+
+// Shutdown shuts the server down gracefully and waits for it to stop. It
+// returns the error from gracefulserver.ServeListener.
+func (s *Server) Shutdown() error {
+	s.cancel(nil)
+	<-s.done
+	return s.err
+}
+
+// Kill stops the server immediately, closing connections without waiting
+// for requests to finish. It returns once the server has stopped and the
+// handlers of those requests have returned.
+func (s *Server) Kill() error {
+	s.cancel(gracefulserver.ErrStop)
+	<-s.done
+	return s.err
+}
+
+// AccessLog returns the access log entries captured so far.
+func (s *Server) AccessLog() []gracefulserver.Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.entries)
+}
+
+// Events returns the lifecycle events captured so far.
+func (s *Server) Events() []gracefulserver.Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.events)
+}
+
+// AssertLogged fails the test unless the access log has an entry for path
+// with status. Entries are logged after the response is written, so it
+// waits briefly for one to show up.
+func (s *Server) AssertLogged(path string, status int) {
+	s.t.Helper()
+	if !s.waitFor(func() bool {
+		return slices.ContainsFunc(s.AccessLog(), func(e gracefulserver.Entry) bool {
+			return e.URL.Path == path && e.Status == status
+		})
+	}) {
+		s.t.Errorf("gracefulservertest: no access log entry for %s with status %d in %v",
+			path, status, s.AccessLog())
+	}
+}
+
+// AssertNotLogged fails the test if the access log has an entry for path.
+func (s *Server) AssertNotLogged(path string) {
+	s.t.Helper()
+	for _, e := range s.AccessLog() {
+		if e.URL.Path == path {
+			s.t.Errorf("gracefulservertest: unexpected access log entry %v", &e)
+		}
+	}
+}
+
+// AssertEvent fails the test unless an event of type typ was captured.
+func (s *Server) AssertEvent(typ gracefulserver.EventType) {
+	s.t.Helper()
+	if !s.waitFor(func() bool {
+		return slices.ContainsFunc(s.Events(), func(ev gracefulserver.Event) bool {
+			return ev.Type == typ
+		})
+	}) {
+		s.t.Errorf("gracefulservertest: no %q event in %v", typ, s.Events())
+	}
+}
+
+// AssertNoEvent fails the test if an event of type typ was captured.
+func (s *Server) AssertNoEvent(typ gracefulserver.EventType) {
+	s.t.Helper()
+	for _, ev := range s.Events() {
+		if ev.Type == typ {
+			s.t.Errorf("gracefulservertest: unexpected %q event: %s", typ, ev.Message)
+		}
+	}
+}
+
+// waitFor polls cond for up to a second.
+func (s *Server) waitFor(cond func() bool) bool {
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
@@ -0,0 +1,96 @@
+package gracefulservertest
+
+import (
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/earthboundkid/gracefulserver"
+)
+
+func TestServer(t *testing.T) {
+	s := Start(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, "hello")
+	}))
+	for _, path := range []string{"/", "/missing"} {
+		resp, err := http.Get(s.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	s.AssertLogged("/", http.StatusOK)
+	s.AssertLogged("/missing", http.StatusNotFound)
+	s.AssertNotLogged("/other")
+	s.AssertEvent(gracefulserver.EventListening)
+	s.AssertNoEvent(gracefulserver.EventStopped)
+
+	if err := s.Shutdown(); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	s.AssertEvent(gracefulserver.EventShuttingDown)
+	s.AssertEvent(gracefulserver.EventStopped)
+	s.AssertNoEvent(gracefulserver.EventTimedOut)
+	if gracefulserver.AccessLog != nil || gracefulserver.OnEvent != nil {
+		t.Fatal("configuration was not restored")
+	}
+}
+
+func TestServerShutdownWaits(t *testing.T) {
+	started := make(chan struct{})
+	s := Start(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		io.WriteString(w, "done")
+	}))
+	body := make(chan string)
+	go func() {
+		resp, err := http.Get(s.URL + "/slow")
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		body <- string(b)
+	}()
+	<-started
+	if err := s.Shutdown(); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if got := <-body; got != "done" {
+		t.Fatalf("got %q, want the full response", got)
+	}
+	s.AssertLogged("/slow", http.StatusOK)
+}
+
+func TestServerKillInFlight(t *testing.T) {
+	started := make(chan struct{})
+	s := Start(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+		// Still running after the server has stopped.
+		time.Sleep(20 * time.Millisecond)
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	go func() {
+		if resp, err := http.Get(s.URL + "/stuck"); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-started
+	s.Kill()
+	s.AssertEvent(gracefulserver.EventStopping)
+	// The handler's entry is logged before Kill returns, and the
+	// configuration is only restored after it.
+	s.AssertLogged("/stuck", http.StatusTeapot)
+	if gracefulserver.AccessLog != nil {
+		t.Fatal("configuration was not restored")
+	}
+}
@@ -0,0 +1,51 @@
+package gracefulserver
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// LogLevel is the minimum level of messages logged by Serve and the
+// middleware in this package. Access log lines are logged at info level.
+// It can be changed at runtime, by the LOG_LEVEL environment variable on
+// reload, or through /debug/loglevel on AdminMux.
+var LogLevel = new(slog.LevelVar)
+
+func logf(level slog.Level, format string, v ...any) {
+	if level >= LogLevel.Level() {
+		log.Output(3, fmt.Sprintf(format, v...))
+	}
+}
+
+func debugf(format string, v ...any) { logf(slog.LevelDebug, format, v...) }
+func infof(format string, v ...any)  { logf(slog.LevelInfo, format, v...) }
+func warnf(format string, v ...any)  { logf(slog.LevelWarn, format, v...) }
+func errorf(format string, v ...any) { logf(slog.LevelError, format, v...) }
+
+// serveLogLevel reports LogLevel, or sets it from a PUT or POST body.
+func serveLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPut, http.MethodPost:
+		b, err := io.ReadAll(io.LimitReader(r.Body, 64))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := LogLevel.UnmarshalText([]byte(strings.TrimSpace(string(b)))); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		warnf("Log level set to %v by %s", LogLevel.Level(), r.RemoteAddr)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, LogLevel.Level())
+}
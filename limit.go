@@ -0,0 +1,169 @@
+package gracefulserver
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ConcurrencyLimit is middleware that bounds the number of requests being
+// handled at once. Requests over the limit wait in a bounded queue; when the
+// queue is full or the wait times out, the client gets a 503 with
+// Retry-After. Add its Wrap method to Middleware to use it alongside Logger.
+type ConcurrencyLimit struct {
+	// Max is the maximum number of requests handled at once. With Adaptive
+	// set, it is the starting and upper limit. Zero or less means no limit.
+	Max int
+	// QueueSize is the number of requests that may wait for a free slot.
+	// Zero means requests over the limit are rejected immediately.
+	QueueSize int
+	// QueueTimeout is how long a queued request waits before it is
+	// rejected. Zero means it waits until the client goes away.
+	QueueTimeout time.Duration
+	// RetryAfter is sent in the Retry-After header of rejections. It
+	// defaults to one second.
+	RetryAfter time.Duration
+	// Adaptive, if set, lowers the limit when latency rises so load is shed
+	// before tail latency blows up.
+	Adaptive *AdaptiveLimit
+
+	once    sync.Once
+	mu      sync.Mutex
+	limit   float64
+	active  int
+	waiting []chan struct{}
+	window  latencyWindow
+}
+
+// AdaptiveLimit configures additive-increase/multiplicative-decrease of a
+// ConcurrencyLimit based on observed request latency.
+type AdaptiveLimit struct {
+	// MinLimit is the lowest the limit may fall. It defaults to 1.
+	MinLimit int
+	// Latency is the duration above which a request counts as a sign of
+	// overload. If zero, twice the lowest recently observed latency is used.
+	Latency time.Duration
+	// Backoff is multiplied into the limit on overload. It defaults to 0.9.
+	Backoff float64
+}
+
+// Wrap returns next guarded by the limit.
+func (cl *ConcurrencyLimit) Wrap(next http.Handler) http.Handler {
+	if cl.Max <= 0 {
+		return next
+	}
+	cl.once.Do(func() {
+		cl.limit = float64(cl.Max)
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !cl.acquire(r) {
+			retryAfter := cl.RetryAfter
+			if retryAfter <= 0 {
+				retryAfter = time.Second
+			}
+			w.Header().Set("Retry-After", seconds(retryAfter))
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		start := time.Now()
+		defer func() { cl.release(time.Since(start)) }()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (cl *ConcurrencyLimit) acquire(r *http.Request) bool {
+	cl.mu.Lock()
+	if cl.active < int(cl.limit) {
+		cl.active++
+		cl.mu.Unlock()
+		return true
+	}
+	if len(cl.waiting) >= cl.QueueSize {
+		cl.mu.Unlock()
+		return false
+	}
+	ready := make(chan struct{})
+	cl.waiting = append(cl.waiting, ready)
+	cl.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if cl.QueueTimeout > 0 {
+		t := time.NewTimer(cl.QueueTimeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case <-ready:
+		return true
+	case <-timeout:
+	case <-r.Context().Done():
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	for i, ch := range cl.waiting {
+		if ch == ready {
+			cl.waiting = append(cl.waiting[:i], cl.waiting[i+1:]...)
+			return false
+		}
+	}
+	// Granted a slot while giving up; take it rather than leak it.
+	return true
+}
+
+func (cl *ConcurrencyLimit) release(latency time.Duration) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.active--
+	if a := cl.Adaptive; a != nil {
+		cl.adapt(a, latency)
+	}
+	for len(cl.waiting) > 0 && cl.active < int(cl.limit) {
+		close(cl.waiting[0])
+		cl.waiting = cl.waiting[1:]
+		cl.active++
+	}
+}
+
+func (cl *ConcurrencyLimit) adapt(a *AdaptiveLimit, latency time.Duration) {
+	threshold := a.Latency
+	if threshold <= 0 {
+		threshold = 2 * cl.window.observe(latency)
+	}
+	minLimit := float64(max(a.MinLimit, 1))
+	if latency > threshold {
+		backoff := a.Backoff
+		if backoff <= 0 || backoff >= 1 {
+			backoff = 0.9
+		}
+		cl.limit = max(cl.limit*backoff, minLimit)
+		return
+	}
+	// Only grow when the current limit is actually being used.
+	if float64(cl.active+1) >= cl.limit/2 {
+		cl.limit = min(cl.limit+1/cl.limit, float64(cl.Max))
+	}
+}
+
+// latencyWindow tracks the lowest latency seen over the last two windows,
+// so the baseline can recover after a slow period.
+type latencyWindow struct {
+	start     time.Time
+	cur, prev time.Duration
+}
+
+const latencyWindowSize = 10 * time.Second
+
+func (lw *latencyWindow) observe(d time.Duration) time.Duration {
+	now := time.Now()
+	if now.Sub(lw.start) > latencyWindowSize {
+		lw.start, lw.prev, lw.cur = now, lw.cur, 0
+	}
+	if lw.cur == 0 || d < lw.cur {
+		lw.cur = d
+	}
+	if lw.prev != 0 && lw.prev < lw.cur {
+		return lw.prev
+	}
+	return lw.cur
+}
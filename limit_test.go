@@ -0,0 +1,205 @@
+package gracefulserver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// waitQueued waits until n requests are queued for cl.
+func waitQueued(t *testing.T, cl *ConcurrencyLimit, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		cl.mu.Lock()
+		queued := len(cl.waiting)
+		cl.mu.Unlock()
+		if queued == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d requests queued, want %d", queued, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	cl := &ConcurrencyLimit{Max: 1, QueueSize: 1, RetryAfter: 3 * time.Second}
+	release := make(chan struct{})
+	started := make(chan string, 2)
+	h := cl.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- r.URL.Path
+		<-release
+	}))
+	serve := func(path string) chan int {
+		code := make(chan int, 1)
+		go func() {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+			code <- w.Code
+		}()
+		return code
+	}
+
+	first := serve("/first")
+	if got := <-started; got != "/first" {
+		t.Fatalf("started %s", got)
+	}
+	second := serve("/second")
+	waitQueued(t, cl, 1)
+
+	// The queue is full, so a third request is turned away.
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/third", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "3" {
+		t.Fatalf("got %d Retry-After %q, want 503 with 3", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	// Finishing the first request hands its slot to the second.
+	release <- struct{}{}
+	if code := <-first; code != http.StatusOK {
+		t.Fatalf("first: got %d", code)
+	}
+	if got := <-started; got != "/second" {
+		t.Fatalf("started %s", got)
+	}
+	cl.mu.Lock()
+	active, queued := cl.active, len(cl.waiting)
+	cl.mu.Unlock()
+	if active != 1 || queued != 0 {
+		t.Fatalf("active=%d queued=%d after handoff, want 1 0", active, queued)
+	}
+	release <- struct{}{}
+	if code := <-second; code != http.StatusOK {
+		t.Fatalf("second: got %d", code)
+	}
+	if cl.active != 0 {
+		t.Fatalf("active=%d after all finished", cl.active)
+	}
+}
+
+func TestConcurrencyLimitQueueTimeout(t *testing.T) {
+	cl := &ConcurrencyLimit{Max: 1, QueueSize: 1, QueueTimeout: 10 * time.Millisecond}
+	release := make(chan struct{})
+	h := cl.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}()
+	waitActive := time.Now().Add(5 * time.Second)
+	for {
+		cl.mu.Lock()
+		active := cl.active
+		cl.mu.Unlock()
+		if active == 1 {
+			break
+		}
+		if time.Now().After(waitActive) {
+			t.Fatal("first request never started")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "1" {
+		t.Fatalf("got %d Retry-After %q, want 503 with 1", w.Code, w.Header().Get("Retry-After"))
+	}
+	close(release)
+	<-done
+	if len(cl.waiting) != 0 || cl.active != 0 {
+		t.Fatalf("active=%d queued=%d, want 0 0", cl.active, len(cl.waiting))
+	}
+}
+
+// TestConcurrencyLimitGrantedWhileGivingUp covers a queued request that
+// gives up at the moment release hands it a slot: it must take the slot
+// rather than leak it.
+func TestConcurrencyLimitGrantedWhileGivingUp(t *testing.T) {
+	cl := &ConcurrencyLimit{Max: 1, QueueSize: 1}
+	cl.Wrap(http.NotFoundHandler())
+	cl.active = 1
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := httptest.NewRequestWithContext(ctx, "GET", "/", nil)
+	acquired := make(chan bool)
+	go func() { acquired <- cl.acquire(r) }()
+	waitQueued(t, cl, 1)
+
+	// Give up and be granted the slot while the waiter can't take the lock.
+	cl.mu.Lock()
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+	cl.active--
+	close(cl.waiting[0])
+	cl.waiting = cl.waiting[1:]
+	cl.active++
+	cl.mu.Unlock()
+
+	if !<-acquired {
+		t.Fatal("granted slot was dropped")
+	}
+	cl.release(0)
+	if cl.active != 0 || len(cl.waiting) != 0 {
+		t.Fatalf("active=%d queued=%d, want 0 0", cl.active, len(cl.waiting))
+	}
+}
+
+func TestConcurrencyLimitUnlimited(t *testing.T) {
+	next := http.NewServeMux()
+	if h := (&ConcurrencyLimit{QueueSize: 1}).Wrap(next); h != next {
+		t.Fatal("zero Max should not limit")
+	}
+}
+
+func TestConcurrencyLimitAdapt(t *testing.T) {
+	a := &AdaptiveLimit{MinLimit: 2, Latency: 100 * time.Millisecond, Backoff: 0.5}
+	for _, tc := range []struct {
+		name    string
+		limit   float64
+		active  int
+		latency time.Duration
+		want    float64
+	}{
+		{"slow backs off", 8, 1, 200 * time.Millisecond, 4},
+		{"slow stops at MinLimit", 3, 1, 200 * time.Millisecond, 2},
+		{"fast grows when in use", 4, 2, 10 * time.Millisecond, 4.25},
+		{"fast doesn't grow when idle", 4, 1, 10 * time.Millisecond, 4},
+		{"fast stops at Max", 8, 8, 10 * time.Millisecond, 8},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cl := &ConcurrencyLimit{Max: 8, Adaptive: a}
+			cl.Wrap(http.NotFoundHandler())
+			cl.limit, cl.active = tc.limit, tc.active
+			cl.release(tc.latency)
+			if cl.limit != tc.want {
+				t.Fatalf("limit = %v, want %v", cl.limit, tc.want)
+			}
+		})
+	}
+}
+
+func TestLatencyWindow(t *testing.T) {
+	var lw latencyWindow
+	if got := lw.observe(50 * time.Millisecond); got != 50*time.Millisecond {
+		t.Fatalf("got %v", got)
+	}
+	if got := lw.observe(20 * time.Millisecond); got != 20*time.Millisecond {
+		t.Fatalf("got %v", got)
+	}
+	// After a window passes the previous minimum still counts...
+	lw.start = lw.start.Add(-2 * latencyWindowSize)
+	if got := lw.observe(80 * time.Millisecond); got != 20*time.Millisecond {
+		t.Fatalf("got %v", got)
+	}
+	// ...but not after two.
+	lw.start = lw.start.Add(-2 * latencyWindowSize)
+	if got := lw.observe(80 * time.Millisecond); got != 80*time.Millisecond {
+		t.Fatalf("got %v", got)
+	}
+}
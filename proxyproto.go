@@ -0,0 +1,301 @@
+package gracefulserver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProxyProtocol configures a listener that reads HAProxy PROXY protocol v1
+// and v2 headers, so connections report the real client as their remote
+// address. Enable it in Serve with
+//
+//	gracefulserver.WrapListener = (&gracefulserver.ProxyProtocol{...}).Listener
+type ProxyProtocol struct {
+	// Allowed are the networks that may send PROXY headers, typically the
+	// load balancers. Headers from other sources are not parsed, so their
+	// clients can't claim another address. If empty, no source may send
+	// them.
+	Allowed []netip.Prefix
+	// ReadHeaderTimeout bounds how long to wait for the header. It defaults
+	// to 5 seconds.
+	ReadHeaderTimeout time.Duration
+	// Optional allows connections from allowed sources that don't send a
+	// header. By default such connections are rejected.
+	Optional bool
+}
+
+// ProxyHeader is a parsed PROXY protocol header.
+type ProxyHeader struct {
+	// Version is 1 or 2.
+	Version int
+	// Local is true for v2 LOCAL commands and v1 UNKNOWN, which carry no
+	// addresses; the connection's own addresses are used.
+	Local bool
+	// Source and Destination are the addresses of the original connection.
+	Source, Destination net.Addr
+	// TLVs are the v2 type-length-value extensions.
+	TLVs []ProxyTLV
+}
+
+// ProxyTLV is a PROXY protocol v2 type-length-value extension.
+type ProxyTLV struct {
+	Type  byte
+	Value []byte
+}
+
+// Listener wraps ln so accepted connections from allowed sources have their
+// PROXY header read and removed. The header is read in the connection's own
+// goroutine on first use, not in Accept.
+func (pp *ProxyProtocol) Listener(ln net.Listener) net.Listener {
+	if len(pp.Allowed) == 0 {
+		warnf("ProxyProtocol has no Allowed networks, so PROXY headers will be refused")
+	}
+	return &proxyListener{ln, pp}
+}
+
+type proxyListener struct {
+	net.Listener
+	pp *ProxyProtocol
+}
+
+func (pl *proxyListener) Accept() (net.Conn, error) {
+	c, err := pl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !pl.pp.allowed(c.RemoteAddr()) {
+		return c, nil
+	}
+	return &proxyConn{Conn: c, r: bufio.NewReader(c), pp: pl.pp}, nil
+}
+
+func (pp *ProxyProtocol) allowed(addr net.Addr) bool {
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := ap.Addr().Unmap()
+	for _, p := range pp.Allowed {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	pp     *ProxyProtocol
+	once   sync.Once
+	header *ProxyHeader
+	err    error
+}
+
+func (pc *proxyConn) init() {
+	pc.once.Do(func() {
+		timeout := pc.pp.ReadHeaderTimeout
+		if timeout <= 0 {
+			timeout = 5 * time.Second
+		}
+		pc.Conn.SetReadDeadline(time.Now().Add(timeout))
+		pc.header, pc.err = readProxyHeader(pc.r)
+		pc.Conn.SetReadDeadline(time.Time{})
+		if pc.err == errNoProxyHeader && pc.pp.Optional {
+			pc.err = nil
+		}
+		if pc.err != nil {
+			pc.err = fmt.Errorf("proxy protocol from %v: %w", pc.Conn.RemoteAddr(), pc.err)
+		}
+	})
+}
+
+func (pc *proxyConn) Read(b []byte) (int, error) {
+	pc.init()
+	if pc.err != nil {
+		return 0, pc.err
+	}
+	return pc.r.Read(b)
+}
+
+func (pc *proxyConn) RemoteAddr() net.Addr {
+	pc.init()
+	if pc.header != nil && !pc.header.Local && pc.header.Source != nil {
+		return pc.header.Source
+	}
+	return pc.Conn.RemoteAddr()
+}
+
+func (pc *proxyConn) LocalAddr() net.Addr {
+	pc.init()
+	if pc.header != nil && !pc.header.Local && pc.header.Destination != nil {
+		return pc.header.Destination
+	}
+	return pc.Conn.LocalAddr()
+}
+
+// ProxyHeaderFromContext returns the PROXY header of the connection that
+// carried the request, if Serve received one.
+func ProxyHeaderFromContext(ctx context.Context) *ProxyHeader {
+	c, _ := ctx.Value(connKey{}).(net.Conn)
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	if pc, ok := c.(*proxyConn); ok {
+		pc.init()
+		return pc.header
+	}
+	return nil
+}
+
+var errNoProxyHeader = errors.New("missing PROXY header")
+
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+func readProxyHeader(r *bufio.Reader) (*ProxyHeader, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch b[0] {
+	case 'P':
+		if b, err = r.Peek(6); err == nil && string(b) == "PROXY " {
+			return readProxyV1(r)
+		}
+	case '\r':
+		if b, err = r.Peek(len(proxyV2Sig)); err == nil && bytes.Equal(b, proxyV2Sig) {
+			return readProxyV2(r)
+		}
+	}
+	return nil, errNoProxyHeader
+}
+
+func readProxyV1(r *bufio.Reader) (*ProxyHeader, error) {
+	// The longest valid v1 header is 107 bytes.
+	var line []byte
+	for len(line) < 107 {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+	s, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, errors.New("malformed PROXY v1 header")
+	}
+	f := strings.Split(s, " ")
+	h := &ProxyHeader{Version: 1}
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		h.Local = true
+		return h, nil
+	}
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed PROXY v1 header %q", s)
+	}
+	src, err1 := parseProxyV1Addr(f[2], f[4])
+	dst, err2 := parseProxyV1Addr(f[3], f[5])
+	if err := errors.Join(err1, err2); err != nil {
+		return nil, fmt.Errorf("malformed PROXY v1 header %q: %w", s, err)
+	}
+	h.Source, h.Destination = src, dst
+	return h, nil
+}
+
+func parseProxyV1Addr(ip, port string) (net.Addr, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(p))), nil
+}
+
+func readProxyV2(r *bufio.Reader) (*ProxyHeader, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY version %d", hdr[12]>>4)
+	}
+	cmd, fam := hdr[12]&0xF, hdr[13]
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	h := &ProxyHeader{Version: 2}
+	switch cmd {
+	case 0:
+		h.Local = true
+		return h, nil
+	case 1:
+	default:
+		return nil, fmt.Errorf("unsupported PROXY v2 command %d", cmd)
+	}
+
+	var n int
+	switch fam >> 4 {
+	case 1, 2:
+		size := 4
+		if fam>>4 == 2 {
+			size = 16
+		}
+		n = 2*size + 4
+		if len(body) < n {
+			return nil, errors.New("short PROXY v2 address block")
+		}
+		src, _ := netip.AddrFromSlice(body[:size])
+		dst, _ := netip.AddrFromSlice(body[size : 2*size])
+		sport := binary.BigEndian.Uint16(body[2*size:])
+		dport := binary.BigEndian.Uint16(body[2*size+2:])
+		if fam&0xF == 2 {
+			h.Source = net.UDPAddrFromAddrPort(netip.AddrPortFrom(src, sport))
+			h.Destination = net.UDPAddrFromAddrPort(netip.AddrPortFrom(dst, dport))
+		} else {
+			h.Source = net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, sport))
+			h.Destination = net.TCPAddrFromAddrPort(netip.AddrPortFrom(dst, dport))
+		}
+	case 3:
+		n = 216
+		if len(body) < n {
+			return nil, errors.New("short PROXY v2 address block")
+		}
+		h.Source = &net.UnixAddr{Name: string(bytes.TrimRight(body[:108], "\x00")), Net: "unix"}
+		h.Destination = &net.UnixAddr{Name: string(bytes.TrimRight(body[108:216], "\x00")), Net: "unix"}
+	default:
+		// AF_UNSPEC: no usable addresses.
+		h.Local = true
+	}
+
+	for tlvs := body[n:]; len(tlvs) > 0; {
+		if len(tlvs) < 3 {
+			return nil, errors.New("malformed PROXY v2 TLV")
+		}
+		size := int(binary.BigEndian.Uint16(tlvs[1:]))
+		if len(tlvs) < 3+size {
+			return nil, errors.New("malformed PROXY v2 TLV")
+		}
+		h.TLVs = append(h.TLVs, ProxyTLV{Type: tlvs[0], Value: tlvs[3 : 3+size]})
+		tlvs = tlvs[3+size:]
+	}
+	return h, nil
+}
@@ -0,0 +1,215 @@
+package gracefulserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// proxyV2 builds a v2 header from its version and command byte, address
+// family byte and payload.
+func proxyV2(verCmd, fam byte, payload ...[]byte) string {
+	body := bytes.Join(payload, nil)
+	b := append([]byte{}, proxyV2Sig...)
+	b = append(b, verCmd, fam)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(body)))
+	return string(append(b, body...))
+}
+
+func tlv(typ byte, value string) []byte {
+	b := binary.BigEndian.AppendUint16([]byte{typ}, uint16(len(value)))
+	return append(b, value...)
+}
+
+func unixPath(name string) []byte {
+	b := make([]byte, 108)
+	copy(b, name)
+	return b
+}
+
+func tcpAddr(s string) net.Addr {
+	return net.TCPAddrFromAddrPort(netip.MustParseAddrPort(s))
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	ipv4 := []byte{192, 0, 2, 1, 198, 51, 100, 2, 0x30, 0x39, 0x01, 0xbb}
+	ipv6 := append(netip.MustParseAddr("2001:db8::1").AsSlice(), netip.MustParseAddr("2001:db8::2").AsSlice()...)
+	ipv6 = append(ipv6, 0x30, 0x39, 0x01, 0xbb)
+	for _, tc := range []struct {
+		name  string
+		input string
+		want  *ProxyHeader
+		err   string
+	}{
+		{
+			name:  "v1 tcp4",
+			input: "PROXY TCP4 192.0.2.1 198.51.100.2 12345 443\r\nGET /",
+			want:  &ProxyHeader{Version: 1, Source: tcpAddr("192.0.2.1:12345"), Destination: tcpAddr("198.51.100.2:443")},
+		},
+		{
+			name:  "v1 tcp6",
+			input: "PROXY TCP6 2001:db8::1 2001:db8::2 12345 443\r\nGET /",
+			want:  &ProxyHeader{Version: 1, Source: tcpAddr("[2001:db8::1]:12345"), Destination: tcpAddr("[2001:db8::2]:443")},
+		},
+		{
+			name:  "v1 unknown",
+			input: "PROXY UNKNOWN ffff::1 ffff::2 1 2\r\nGET /",
+			want:  &ProxyHeader{Version: 1, Local: true},
+		},
+		{
+			name:  "v1 missing crlf",
+			input: "PROXY TCP4 192.0.2.1 198.51.100.2 12345 443\nGET /",
+			err:   "malformed",
+		},
+		{
+			name:  "v1 too long",
+			input: "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n",
+			err:   "malformed",
+		},
+		{
+			name:  "v1 bad protocol",
+			input: "PROXY UDP4 192.0.2.1 198.51.100.2 12345 443\r\n",
+			err:   "malformed",
+		},
+		{
+			name:  "v1 bad address",
+			input: "PROXY TCP4 192.0.2 198.51.100.2 12345 443\r\n",
+			err:   "malformed",
+		},
+		{
+			name:  "v1 bad port",
+			input: "PROXY TCP4 192.0.2.1 198.51.100.2 123456 443\r\n",
+			err:   "malformed",
+		},
+		{
+			name:  "v2 tcp4",
+			input: proxyV2(0x21, 0x11, ipv4) + "GET /",
+			want:  &ProxyHeader{Version: 2, Source: tcpAddr("192.0.2.1:12345"), Destination: tcpAddr("198.51.100.2:443")},
+		},
+		{
+			name:  "v2 tcp6",
+			input: proxyV2(0x21, 0x21, ipv6),
+			want:  &ProxyHeader{Version: 2, Source: tcpAddr("[2001:db8::1]:12345"), Destination: tcpAddr("[2001:db8::2]:443")},
+		},
+		{
+			name:  "v2 udp4",
+			input: proxyV2(0x21, 0x12, ipv4),
+			want: &ProxyHeader{
+				Version:     2,
+				Source:      net.UDPAddrFromAddrPort(netip.MustParseAddrPort("192.0.2.1:12345")),
+				Destination: net.UDPAddrFromAddrPort(netip.MustParseAddrPort("198.51.100.2:443")),
+			},
+		},
+		{
+			name:  "v2 unix",
+			input: proxyV2(0x21, 0x31, unixPath("/run/src.sock"), unixPath("/run/dst.sock")),
+			want: &ProxyHeader{
+				Version:     2,
+				Source:      &net.UnixAddr{Name: "/run/src.sock", Net: "unix"},
+				Destination: &net.UnixAddr{Name: "/run/dst.sock", Net: "unix"},
+			},
+		},
+		{
+			name:  "v2 tlvs",
+			input: proxyV2(0x21, 0x11, ipv4, tlv(0x01, "h2"), tlv(0x04, "")),
+			want: &ProxyHeader{
+				Version:     2,
+				Source:      tcpAddr("192.0.2.1:12345"),
+				Destination: tcpAddr("198.51.100.2:443"),
+				TLVs:        []ProxyTLV{{Type: 0x01, Value: []byte("h2")}, {Type: 0x04, Value: []byte{}}},
+			},
+		},
+		{
+			name:  "v2 local",
+			input: proxyV2(0x20, 0x11, ipv4),
+			want:  &ProxyHeader{Version: 2, Local: true},
+		},
+		{
+			name:  "v2 unspec",
+			input: proxyV2(0x21, 0x00),
+			want:  &ProxyHeader{Version: 2, Local: true},
+		},
+		{
+			name:  "v2 bad version",
+			input: proxyV2(0x11, 0x11, ipv4),
+			err:   "unsupported PROXY version",
+		},
+		{
+			name:  "v2 bad command",
+			input: proxyV2(0x22, 0x11, ipv4),
+			err:   "unsupported PROXY v2 command",
+		},
+		{
+			name:  "v2 short addresses",
+			input: proxyV2(0x21, 0x21, ipv4),
+			err:   "short PROXY v2 address block",
+		},
+		{
+			name:  "v2 truncated tlv",
+			input: proxyV2(0x21, 0x11, ipv4, tlv(0x01, "h2")[:4]),
+			err:   "malformed PROXY v2 TLV",
+		},
+		{
+			name:  "v2 truncated body",
+			input: proxyV2(0x21, 0x11, ipv4)[:20],
+			err:   "EOF",
+		},
+		{
+			name:  "no header",
+			input: "GET / HTTP/1.1\r\n\r\n",
+			err:   errNoProxyHeader.Error(),
+		},
+		{
+			name:  "proxy prefix only",
+			input: "PROXYGET /\r\n",
+			err:   errNoProxyHeader.Error(),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tc.input))
+			h, err := readProxyHeader(r)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("got error %v, want %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(h, tc.want) {
+				t.Fatalf("got %+v, want %+v", h, tc.want)
+			}
+			if rest, _ := r.Peek(r.Buffered()); strings.HasSuffix(tc.input, "GET /") && string(rest) != "GET /" {
+				t.Fatalf("header not consumed: %q remains", rest)
+			}
+		})
+	}
+}
+
+func TestProxyProtocolAllowed(t *testing.T) {
+	lb := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	for _, tc := range []struct {
+		name    string
+		allowed []netip.Prefix
+		addr    string
+		want    bool
+	}{
+		{"empty allows none", nil, "10.1.2.3:1234", false},
+		{"inside", lb, "10.1.2.3:1234", true},
+		{"outside", lb, "192.0.2.1:1234", false},
+		{"mapped", lb, "[::ffff:10.1.2.3]:1234", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pp := &ProxyProtocol{Allowed: tc.allowed}
+			if got := pp.allowed(tcpAddr(tc.addr)); got != tc.want {
+				t.Fatalf("allowed(%s) = %v, want %v", tc.addr, got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package gracefulserver
+
+import (
+	"container/list"
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimiter is token bucket middleware that limits requests per client.
+// Requests over the limit get a 429 with Retry-After. Every response carries
+// RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers. Add its
+// Wrap method to Middleware to use it.
+type RateLimiter struct {
+	// Rate is the number of requests per second a client may make. Zero
+	// or less means no limit, so the limit can be lifted on reload with
+	// RATE_LIMIT=0.
+	Rate float64
+	// Burst is the size of each client's bucket. It defaults to 1.
+	Burst int
+	// Key returns the bucket for a request. It defaults to KeyByIP.
+	// Requests with an empty key are not limited.
+	Key func(r *http.Request) string
+	// Store holds the buckets. It defaults to a MemoryStore.
+	Store RateLimitStore
+
+	mu sync.RWMutex
+}
+
+// SetLimit changes Rate and Burst of a limiter that is in use. Serve calls
+// it on reload for ConfigRateLimiter.
+func (rl *RateLimiter) SetLimit(rate float64, burst int) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.Rate, rl.Burst = rate, burst
+}
+
+func (rl *RateLimiter) limit() (rate float64, burst int) {
+	rl.mu.RLock()
+	defer rl.mu.RUnlock()
+	return rl.Rate, max(rl.Burst, 1)
+}
+
+// RateLimitStore holds token buckets for a RateLimiter. Implementations
+// backed by a shared service let several instances enforce one limit.
+type RateLimitStore interface {
+	// Take removes a token from the bucket for key, first refilling it at
+	// rate tokens per second up to burst.
+	Take(ctx context.Context, key string, rate float64, burst int) (RateLimitResult, error)
+}
+
+// RateLimitResult is the state of a bucket after Take.
+type RateLimitResult struct {
+	// Allowed reports whether a token was available.
+	Allowed bool
+	// Remaining is the number of whole tokens left in the bucket.
+	Remaining int
+	// Reset is the time until the bucket is full again.
+	Reset time.Duration
+	// RetryAfter is the time until a token is available if not Allowed.
+	RetryAfter time.Duration
+}
+
+// KeyByIP is the default RateLimiter key, the client address resolved by
+// RealIP or else the host part of r.RemoteAddr.
+func KeyByIP(r *http.Request) string {
+	if ci, ok := ClientFromContext(r.Context()); ok && ci.IP.IsValid() {
+		return ci.IP.String()
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// KeyByHeader returns a RateLimiter key function that uses the value of
+// the named header, such as an API key.
+func KeyByHeader(name string) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		return r.Header.Get(name)
+	}
+}
+
+// Wrap returns next guarded by the rate limit.
+func (rl *RateLimiter) Wrap(next http.Handler) http.Handler {
+	key := rl.Key
+	if key == nil {
+		key = KeyByIP
+	}
+	store := rl.Store
+	if store == nil {
+		store = &MemoryStore{}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		k := key(r)
+		if k == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rate, burst := rl.limit()
+		if rate <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		res, err := store.Take(r.Context(), k, rate, burst)
+		if err != nil {
+			// Fail open: a broken store shouldn't take the service down.
+			errorf("Rate limit store error: %v", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		h := w.Header()
+		h.Set("RateLimit-Limit", strconv.Itoa(burst))
+		h.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+		h.Set("RateLimit-Reset", seconds(res.Reset))
+		if !res.Allowed {
+			h.Set("Retry-After", seconds(res.RetryAfter))
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// seconds formats d as whole seconds, rounded up, for HTTP headers.
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// MemoryStore is an in-process RateLimitStore. When it holds more than
+// MaxKeys buckets, the least recently used are evicted.
+type MemoryStore struct {
+	// MaxKeys defaults to 10,000.
+	MaxKeys int
+
+	mu      sync.Mutex
+	lru     list.List
+	buckets map[string]*list.Element
+}
+
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// Take implements RateLimitStore.
+func (ms *MemoryStore) Take(ctx context.Context, key string, rate float64, burst int) (RateLimitResult, error) {
+	now := time.Now()
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.buckets == nil {
+		ms.buckets = make(map[string]*list.Element)
+	}
+	var b *bucket
+	if el, ok := ms.buckets[key]; ok {
+		ms.lru.MoveToFront(el)
+		b = el.Value.(*bucket)
+		b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*rate, float64(burst))
+		b.last = now
+	} else {
+		b = &bucket{key: key, tokens: float64(burst), last: now}
+		ms.buckets[key] = ms.lru.PushFront(b)
+		maxKeys := ms.MaxKeys
+		if maxKeys <= 0 {
+			maxKeys = 10_000
+		}
+		for ms.lru.Len() > maxKeys {
+			el := ms.lru.Back()
+			ms.lru.Remove(el)
+			delete(ms.buckets, el.Value.(*bucket).key)
+		}
+	}
+	var res RateLimitResult
+	if b.tokens >= 1 {
+		b.tokens--
+		res.Allowed = true
+	} else if rate > 0 {
+		res.RetryAfter = time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	} else {
+		res.RetryAfter = time.Hour
+	}
+	res.Remaining = int(b.tokens)
+	if rate > 0 {
+		res.Reset = time.Duration((float64(burst) - b.tokens) / rate * float64(time.Second))
+	}
+	return res, nil
+}
@@ -0,0 +1,145 @@
+package gracefulserver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreRefill(t *testing.T) {
+	ms := &MemoryStore{}
+	ctx := context.Background()
+	// age moves the bucket's last refill back by d.
+	age := func(d time.Duration) {
+		ms.buckets["k"].Value.(*bucket).last = time.Now().Add(-d)
+	}
+	for _, step := range []struct {
+		name      string
+		age       time.Duration
+		allowed   bool
+		remaining int
+	}{
+		{"first takes from full bucket", 0, true, 2},
+		{"second", 0, true, 1},
+		{"third", 0, true, 0},
+		{"empty", 0, false, 0},
+		{"half refilled", 50 * time.Millisecond, false, 0},
+		{"one token refilled", 100 * time.Millisecond, true, 0},
+		{"refill capped at burst", time.Hour, true, 2},
+	} {
+		if step.age > 0 {
+			age(step.age)
+		}
+		res, err := ms.Take(ctx, "k", 10, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Allowed != step.allowed || res.Remaining != step.remaining {
+			t.Fatalf("%s: got allowed=%v remaining=%d, want %v %d",
+				step.name, res.Allowed, res.Remaining, step.allowed, step.remaining)
+		}
+		if !res.Allowed && (res.RetryAfter <= 0 || res.RetryAfter > 100*time.Millisecond) {
+			t.Fatalf("%s: RetryAfter = %v", step.name, res.RetryAfter)
+		}
+		if res.Reset < 0 || res.Reset > 300*time.Millisecond {
+			t.Fatalf("%s: Reset = %v", step.name, res.Reset)
+		}
+	}
+}
+
+func TestMemoryStoreEviction(t *testing.T) {
+	ms := &MemoryStore{MaxKeys: 2}
+	ctx := context.Background()
+	for _, key := range []string{"a", "b", "a", "c"} {
+		if _, err := ms.Take(ctx, key, 1, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// b was least recently used when c arrived.
+	if _, ok := ms.buckets["b"]; ok || len(ms.buckets) != 2 || ms.lru.Len() != 2 {
+		t.Fatalf("buckets after eviction: %v", ms.buckets)
+	}
+	// a kept its empty bucket; b starts over with a full one.
+	if res, _ := ms.Take(ctx, "a", 1, 1); res.Allowed {
+		t.Fatal("a was refilled")
+	}
+	if res, _ := ms.Take(ctx, "b", 1, 1); !res.Allowed {
+		t.Fatal("b was not evicted")
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		rl     *RateLimiter
+		remote []string
+		codes  []int
+		header bool
+	}{
+		{
+			name:   "burst then limited",
+			rl:     &RateLimiter{Rate: 0.001, Burst: 2},
+			remote: []string{"192.0.2.1:1", "192.0.2.1:2", "192.0.2.1:3"},
+			codes:  []int{200, 200, 429},
+			header: true,
+		},
+		{
+			name:   "clients limited separately",
+			rl:     &RateLimiter{Rate: 0.001},
+			remote: []string{"192.0.2.1:1", "192.0.2.2:1", "192.0.2.1:1"},
+			codes:  []int{200, 200, 429},
+			header: true,
+		},
+		{
+			name:   "zero rate is no limit",
+			rl:     &RateLimiter{},
+			remote: []string{"192.0.2.1:1", "192.0.2.1:1", "192.0.2.1:1"},
+			codes:  []int{200, 200, 200},
+		},
+		{
+			name:   "empty key not limited",
+			rl:     &RateLimiter{Rate: 0.001, Key: KeyByHeader("X-Api-Key")},
+			remote: []string{"192.0.2.1:1", "192.0.2.1:1"},
+			codes:  []int{200, 200},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := tc.rl.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			for i, remote := range tc.remote {
+				r := httptest.NewRequest("GET", "/", nil)
+				r.RemoteAddr = remote
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, r)
+				if w.Code != tc.codes[i] {
+					t.Fatalf("request %d: got %d, want %d", i, w.Code, tc.codes[i])
+				}
+				if got := w.Header().Get("RateLimit-Limit") != ""; got != tc.header {
+					t.Fatalf("request %d: RateLimit headers %v, want %v", i, w.Header(), tc.header)
+				}
+				if w.Code == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+					t.Fatalf("request %d: no Retry-After", i)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimiterSetLimit(t *testing.T) {
+	rl := &RateLimiter{Rate: 0.001}
+	h := rl.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	serve := func() int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		return w.Code
+	}
+	serve()
+	if code := serve(); code != http.StatusTooManyRequests {
+		t.Fatalf("got %d, want 429", code)
+	}
+	rl.SetLimit(0, 0)
+	if code := serve(); code != http.StatusOK {
+		t.Fatalf("after lifting the limit got %d, want 200", code)
+	}
+}
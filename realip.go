@@ -0,0 +1,190 @@
+package gracefulserver
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ClientInfo describes the original client of a request that may have
+// passed through proxies.
+type ClientInfo struct {
+	// IP is the client address. It is invalid if none could be resolved.
+	IP netip.Addr
+	// Scheme is "http" or "https" as seen by the client.
+	Scheme string
+	// Host is the host the client asked for.
+	Host string
+}
+
+type clientKey struct{}
+
+// ClientFromContext returns the ClientInfo resolved by RealIP.
+func ClientFromContext(ctx context.Context) (ClientInfo, bool) {
+	ci, ok := ctx.Value(clientKey{}).(ClientInfo)
+	return ci, ok
+}
+
+// RealIP is middleware that resolves the real client address, scheme and
+// host of a request from the Forwarded, X-Forwarded-For, X-Forwarded-Proto,
+// X-Forwarded-Host and X-Real-IP headers. Headers are only believed when the
+// request comes from a trusted proxy, and forwarding chains are read from
+// the right so a client cannot spoof its address by sending the headers
+// itself. The result is available from ClientFromContext and is recorded in
+// the request's Entry.
+type RealIP struct {
+	// TrustedProxies are the networks of proxies whose headers are
+	// believed.
+	TrustedProxies []netip.Prefix
+}
+
+// Wrap returns next with client information in the request context.
+func (ri *RealIP) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ci := ri.Resolve(r)
+		if e := EntryFromContext(r.Context()); e != nil && ci.IP.IsValid() {
+			e.ClientIP = ci.IP.String()
+		}
+		r = r.WithContext(context.WithValue(r.Context(), clientKey{}, ci))
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (ri *RealIP) trusted(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, p := range ri.TrustedProxies {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve returns the client information for r.
+func (ri *RealIP) Resolve(r *http.Request) ClientInfo {
+	ci := ClientInfo{Scheme: "http", Host: r.Host}
+	if r.TLS != nil {
+		ci.Scheme = "https"
+	}
+	ci.IP = parseNode(r.RemoteAddr)
+	if !ci.IP.IsValid() || !ri.trusted(ci.IP) {
+		return ci
+	}
+
+	if fwd := r.Header.Values("Forwarded"); len(fwd) > 0 {
+		elems := parseForwarded(fwd)
+		i := ri.walk(len(elems), func(i int) string { return elems[i]["for"] }, &ci.IP)
+		if i >= 0 {
+			if proto := elems[i]["proto"]; proto != "" {
+				ci.Scheme = strings.ToLower(proto)
+			}
+			if host := elems[i]["host"]; host != "" {
+				ci.Host = host
+			}
+		}
+		return ci
+	}
+
+	if xff := headerList(r.Header, "X-Forwarded-For"); len(xff) > 0 {
+		ri.walk(len(xff), func(i int) string { return xff[i] }, &ci.IP)
+	} else if ip := parseNode(r.Header.Get("X-Real-IP")); ip.IsValid() {
+		ci.IP = ip
+	}
+	if proto := headerList(r.Header, "X-Forwarded-Proto"); len(proto) > 0 {
+		ci.Scheme = strings.ToLower(proto[len(proto)-1])
+	}
+	if host := headerList(r.Header, "X-Forwarded-Host"); len(host) > 0 {
+		ci.Host = host[len(host)-1]
+	}
+	return ci
+}
+
+// walk reads a forwarding chain of n hops from the right, setting ip to
+// each hop until one is not a trusted proxy. It returns the index of the
+// hop used, or -1 if none was.
+func (ri *RealIP) walk(n int, node func(i int) string, ip *netip.Addr) int {
+	used := -1
+	for i := n - 1; i >= 0; i-- {
+		addr := parseNode(node(i))
+		if !addr.IsValid() {
+			// Unknown or obfuscated; the last trusted hop is as far as we can see.
+			break
+		}
+		*ip, used = addr, i
+		if !ri.trusted(addr) {
+			break
+		}
+	}
+	return used
+}
+
+// parseNode parses an address with an optional port, brackets or quotes.
+func parseNode(s string) netip.Addr {
+	s = strings.Trim(strings.TrimSpace(s), `"`)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	ip, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}
+	}
+	return ip.Unmap()
+}
+
+// headerList splits the comma separated values of a header.
+func headerList(h http.Header, name string) []string {
+	var list []string
+	for _, v := range h.Values(name) {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return list
+}
+
+// parseForwarded parses RFC 7239 Forwarded headers into one map of
+// lowercased parameter names to values per element.
+func parseForwarded(values []string) []map[string]string {
+	var elems []map[string]string
+	for _, v := range values {
+		for _, elem := range splitQuoted(v, ',') {
+			params := make(map[string]string)
+			for _, pair := range splitQuoted(elem, ';') {
+				k, val, ok := strings.Cut(pair, "=")
+				if !ok {
+					continue
+				}
+				val = strings.TrimSpace(val)
+				if len(val) >= 2 && val[0] == '"' && val[len(val)-1] == '"' {
+					val = strings.ReplaceAll(val[1:len(val)-1], `\"`, `"`)
+				}
+				params[strings.ToLower(strings.TrimSpace(k))] = val
+			}
+			elems = append(elems, params)
+		}
+	}
+	return elems
+}
+
+// splitQuoted splits s on sep outside of double quotes.
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted, start := false, 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && quoted:
+			i++
+		case c == '"':
+			quoted = !quoted
+		case c == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
@@ -0,0 +1,175 @@
+package gracefulserver
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestRealIPResolve(t *testing.T) {
+	ri := &RealIP{TrustedProxies: []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("fd00::/8"),
+	}}
+	for _, tc := range []struct {
+		name   string
+		remote string
+		tls    bool
+		header http.Header
+		want   ClientInfo
+	}{
+		{
+			name:   "direct",
+			remote: "192.0.2.1:1234",
+			want:   ClientInfo{IP: netip.MustParseAddr("192.0.2.1"), Scheme: "http", Host: "example.com"},
+		},
+		{
+			name:   "direct tls",
+			remote: "192.0.2.1:1234",
+			tls:    true,
+			want:   ClientInfo{IP: netip.MustParseAddr("192.0.2.1"), Scheme: "https", Host: "example.com"},
+		},
+		{
+			name:   "untrusted peer spoofs xff",
+			remote: "192.0.2.1:1234",
+			header: http.Header{
+				"X-Forwarded-For":   {"203.0.113.9"},
+				"X-Forwarded-Proto": {"https"},
+				"X-Forwarded-Host":  {"evil.example"},
+			},
+			want: ClientInfo{IP: netip.MustParseAddr("192.0.2.1"), Scheme: "http", Host: "example.com"},
+		},
+		{
+			name:   "untrusted peer spoofs forwarded",
+			remote: "192.0.2.1:1234",
+			header: http.Header{"Forwarded": {"for=203.0.113.9;proto=https"}},
+			want:   ClientInfo{IP: netip.MustParseAddr("192.0.2.1"), Scheme: "http", Host: "example.com"},
+		},
+		{
+			name:   "untrusted peer spoofs x-real-ip",
+			remote: "192.0.2.1:1234",
+			header: http.Header{"X-Real-Ip": {"203.0.113.9"}},
+			want:   ClientInfo{IP: netip.MustParseAddr("192.0.2.1"), Scheme: "http", Host: "example.com"},
+		},
+		{
+			name:   "trusted proxy",
+			remote: "10.0.0.1:1234",
+			header: http.Header{
+				"X-Forwarded-For":   {"192.0.2.1"},
+				"X-Forwarded-Proto": {"HTTPS"},
+				"X-Forwarded-Host":  {"app.example"},
+			},
+			want: ClientInfo{IP: netip.MustParseAddr("192.0.2.1"), Scheme: "https", Host: "app.example"},
+		},
+		{
+			name:   "client prepends to xff",
+			remote: "10.0.0.1:1234",
+			header: http.Header{"X-Forwarded-For": {"203.0.113.9, 192.0.2.1"}},
+			want:   ClientInfo{IP: netip.MustParseAddr("192.0.2.1"), Scheme: "http", Host: "example.com"},
+		},
+		{
+			name:   "client sends its own xff header",
+			remote: "10.0.0.1:1234",
+			header: http.Header{"X-Forwarded-For": {"203.0.113.9", "192.0.2.1"}},
+			want:   ClientInfo{IP: netip.MustParseAddr("192.0.2.1"), Scheme: "http", Host: "example.com"},
+		},
+		{
+			name:   "chain of trusted proxies",
+			remote: "10.0.0.1:1234",
+			header: http.Header{"X-Forwarded-For": {"203.0.113.9, 192.0.2.1, 10.0.0.3, 10.0.0.2"}},
+			want:   ClientInfo{IP: netip.MustParseAddr("192.0.2.1"), Scheme: "http", Host: "example.com"},
+		},
+		{
+			name:   "every hop trusted",
+			remote: "10.0.0.1:1234",
+			header: http.Header{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}},
+			want:   ClientInfo{IP: netip.MustParseAddr("10.0.0.3"), Scheme: "http", Host: "example.com"},
+		},
+		{
+			name:   "garbage stops the walk",
+			remote: "10.0.0.1:1234",
+			header: http.Header{"X-Forwarded-For": {"192.0.2.1, not-an-ip, 10.0.0.2"}},
+			want:   ClientInfo{IP: netip.MustParseAddr("10.0.0.2"), Scheme: "http", Host: "example.com"},
+		},
+		{
+			name:   "last proto and host win",
+			remote: "10.0.0.1:1234",
+			header: http.Header{
+				"X-Forwarded-For":   {"192.0.2.1"},
+				"X-Forwarded-Proto": {"http, https"},
+				"X-Forwarded-Host":  {"evil.example", "app.example"},
+			},
+			want: ClientInfo{IP: netip.MustParseAddr("192.0.2.1"), Scheme: "https", Host: "app.example"},
+		},
+		{
+			name:   "x-real-ip",
+			remote: "10.0.0.1:1234",
+			header: http.Header{"X-Real-Ip": {"192.0.2.1"}},
+			want:   ClientInfo{IP: netip.MustParseAddr("192.0.2.1"), Scheme: "http", Host: "example.com"},
+		},
+		{
+			name:   "xff preferred to x-real-ip",
+			remote: "10.0.0.1:1234",
+			header: http.Header{"X-Forwarded-For": {"192.0.2.1"}, "X-Real-Ip": {"203.0.113.9"}},
+			want:   ClientInfo{IP: netip.MustParseAddr("192.0.2.1"), Scheme: "http", Host: "example.com"},
+		},
+		{
+			name:   "forwarded",
+			remote: "10.0.0.1:1234",
+			header: http.Header{"Forwarded": {`for="[2001:db8::1]:4711";proto=HTTPS;host=app.example`}},
+			want:   ClientInfo{IP: netip.MustParseAddr("2001:db8::1"), Scheme: "https", Host: "app.example"},
+		},
+		{
+			name:   "client prepends to forwarded",
+			remote: "10.0.0.1:1234",
+			header: http.Header{"Forwarded": {"for=203.0.113.9;host=evil.example, for=192.0.2.1;host=app.example"}},
+			want:   ClientInfo{IP: netip.MustParseAddr("192.0.2.1"), Scheme: "http", Host: "app.example"},
+		},
+		{
+			name:   "forwarded through trusted proxies",
+			remote: "10.0.0.1:1234",
+			header: http.Header{"Forwarded": {"for=192.0.2.1;proto=https", `for="[fd00::2]"`}},
+			want:   ClientInfo{IP: netip.MustParseAddr("192.0.2.1"), Scheme: "https", Host: "example.com"},
+		},
+		{
+			name:   "forwarded preferred to xff",
+			remote: "10.0.0.1:1234",
+			header: http.Header{"Forwarded": {"for=192.0.2.1"}, "X-Forwarded-For": {"203.0.113.9"}},
+			want:   ClientInfo{IP: netip.MustParseAddr("192.0.2.1"), Scheme: "http", Host: "example.com"},
+		},
+		{
+			name:   "forwarded unknown",
+			remote: "10.0.0.1:1234",
+			header: http.Header{"Forwarded": {"for=unknown;proto=https"}},
+			want:   ClientInfo{IP: netip.MustParseAddr("10.0.0.1"), Scheme: "http", Host: "example.com"},
+		},
+		{
+			name:   "mapped peer",
+			remote: "[::ffff:10.0.0.1]:1234",
+			header: http.Header{"X-Forwarded-For": {"192.0.2.1"}},
+			want:   ClientInfo{IP: netip.MustParseAddr("192.0.2.1"), Scheme: "http", Host: "example.com"},
+		},
+		{
+			name:   "bad remote address",
+			remote: "pipe",
+			header: http.Header{"X-Forwarded-For": {"192.0.2.1"}},
+			want:   ClientInfo{Scheme: "http", Host: "example.com"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "http://example.com/", nil)
+			r.RemoteAddr = tc.remote
+			if tc.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+			for k, v := range tc.header {
+				r.Header[k] = v
+			}
+			if got := ri.Resolve(r); got != tc.want {
+				t.Fatalf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package gracefulserver
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Redactor hides sensitive values before they are logged. Names are
+// matched without regard to case.
+type Redactor struct {
+	// QueryParams are query parameters whose values are redacted. Form
+	// fields and JSON members in bodies recorded by BodyCapture are
+	// matched against them too.
+	QueryParams []string
+	// Headers are headers whose values are redacted.
+	Headers []string
+	// NamePatterns redact query parameters and headers with matching
+	// names.
+	NamePatterns []*regexp.Regexp
+	// PathSegments redact path segments that match, such as email
+	// addresses or tokens in the path.
+	PathSegments []*regexp.Regexp
+	// Replacement replaces redacted values. It defaults to "REDACTED".
+	Replacement string
+}
+
+// DefaultRedactor redacts common credential parameters and the
+// Authorization header.
+var DefaultRedactor = &Redactor{
+	QueryParams: []string{"token", "password", "api_key"},
+	Headers:     []string{"Authorization"},
+}
+
+// Redact is applied to access log entries before they reach AccessLog or
+// the standard logger. Set it to nil to log URLs as they are.
+var Redact = DefaultRedactor
+
+func (rd *Redactor) replacement() string {
+	if rd.Replacement != "" {
+		return rd.Replacement
+	}
+	return "REDACTED"
+}
+
+func (rd *Redactor) matchName(name string, names []string) bool {
+	if slices.ContainsFunc(names, func(n string) bool { return strings.EqualFold(n, name) }) {
+		return true
+	}
+	return slices.ContainsFunc(rd.NamePatterns, func(re *regexp.Regexp) bool { return re.MatchString(name) })
+}
+
+// URL returns a copy of u with sensitive query parameters and path
+// segments redacted, or u itself if nothing needed redacting.
+func (rd *Redactor) URL(u *url.URL) *url.URL {
+	if u == nil {
+		return nil
+	}
+	query, qok := rd.query(u.RawQuery)
+	path, pok := rd.path(u.Path)
+	if !qok && !pok {
+		return u
+	}
+	c := *u
+	c.RawQuery = query
+	if pok {
+		c.Path, c.RawPath = path, ""
+	}
+	return &c
+}
+
+// query redacts raw, keeping the order and encoding of the parameters.
+func (rd *Redactor) query(raw string) (string, bool) {
+	if raw == "" {
+		return raw, false
+	}
+	params := strings.Split(raw, "&")
+	changed := false
+	for i, p := range params {
+		k, _, ok := strings.Cut(p, "=")
+		if !ok {
+			continue
+		}
+		name, err := url.QueryUnescape(k)
+		if err != nil {
+			name = k
+		}
+		if rd.matchName(name, rd.QueryParams) {
+			params[i] = k + "=" + url.QueryEscape(rd.replacement())
+			changed = true
+		}
+	}
+	return strings.Join(params, "&"), changed
+}
+
+func (rd *Redactor) path(p string) (string, bool) {
+	if len(rd.PathSegments) == 0 {
+		return p, false
+	}
+	segs := strings.Split(p, "/")
+	changed := false
+	for i, seg := range segs {
+		if seg != "" && slices.ContainsFunc(rd.PathSegments, func(re *regexp.Regexp) bool { return re.MatchString(seg) }) {
+			segs[i] = rd.replacement()
+			changed = true
+		}
+	}
+	return strings.Join(segs, "/"), changed
+}
+
+// Header returns a copy of h with sensitive values redacted. Entries don't
+// carry request headers, so AccessLogger implementations and handlers that
+// log headers should pass them through Redact.Header first.
+func (rd *Redactor) Header(h http.Header) http.Header {
+	c := h.Clone()
+	for name, vals := range c {
+		if rd.matchName(name, rd.Headers) {
+			for i := range vals {
+				vals[i] = rd.replacement()
+			}
+		}
+	}
+	return c
+}
+
+// redactURL applies Redact to u.
+func redactURL(u *url.URL) *url.URL {
+	if rd := Redact; rd != nil {
+		return rd.URL(u)
+	}
+	return u
+}
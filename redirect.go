@@ -0,0 +1,97 @@
+package gracefulserver
+
+import (
+	"net"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// SlashPolicy is how RedirectPolicy treats trailing slashes in paths.
+type SlashPolicy int
+
+const (
+	// SlashAsIs leaves paths alone.
+	SlashAsIs SlashPolicy = iota
+	// SlashAdd redirects paths without a trailing slash to ones with it.
+	// Paths whose last segment has a file extension are left alone.
+	SlashAdd
+	// SlashRemove redirects paths with a trailing slash to ones without.
+	SlashRemove
+)
+
+// RedirectPolicy redirects requests to a canonical URL with a 308
+// Permanent Redirect.
+type RedirectPolicy struct {
+	// Host is the canonical host, such as "www.example.com" or
+	// "example.com". If empty, any host is accepted.
+	Host string
+	// TrailingSlash is the trailing slash policy.
+	TrailingSlash SlashPolicy
+}
+
+// canonicalPath returns p adjusted for the trailing slash policy.
+func (rp *RedirectPolicy) canonicalPath(p string) string {
+	if p == "/" || p == "" {
+		return "/"
+	}
+	switch rp.TrailingSlash {
+	case SlashAdd:
+		if !strings.HasSuffix(p, "/") && path.Ext(p) == "" {
+			return p + "/"
+		}
+	case SlashRemove:
+		if p = strings.TrimRight(p, "/"); p == "" {
+			return "/"
+		}
+	}
+	return p
+}
+
+// canonicalHost returns the host to redirect to, keeping any port.
+func (rp *RedirectPolicy) canonicalHost(host string) string {
+	if rp.Host == "" {
+		return host
+	}
+	if _, port, err := net.SplitHostPort(host); err == nil {
+		return net.JoinHostPort(rp.Host, port)
+	}
+	return rp.Host
+}
+
+// Wrap returns next behind redirects to the canonical host and path.
+func (rp *RedirectPolicy) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, p := rp.canonicalHost(r.Host), rp.canonicalPath(r.URL.Path)
+		if host == r.Host && p == r.URL.Path {
+			next.ServeHTTP(w, r)
+			return
+		}
+		u := *r.URL
+		u.Scheme, u.Host, u.Path, u.RawPath = "http", host, p, ""
+		if isHTTPS(r) {
+			u.Scheme = "https"
+		}
+		http.Redirect(w, r, u.String(), http.StatusPermanentRedirect)
+	})
+}
+
+// toHTTPS returns a handler that redirects to the canonical HTTPS URL on
+// port.
+func (rp *RedirectPolicy) toHTTPS(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if rp.Host != "" {
+			host = rp.Host
+		}
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		u := *r.URL
+		u.Scheme, u.Host, u.Path, u.RawPath = "https", host, rp.canonicalPath(r.URL.Path), ""
+		http.Redirect(w, r, u.String(), http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,158 @@
+package gracefulserver
+
+import (
+	"bufio"
+	"crypto/tls"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ConfigFile, if set, is a file of KEY=VALUE lines that Serve loads into
+// the environment at startup and on each reload, before applying the
+// settings below and running OnReload hooks. Blank lines and lines
+// starting with # are ignored.
+//
+// Serve reads these settings from the environment:
+//
+//	LOG_LEVEL                     LogLevel
+//	LOG_SAMPLE_RATE               Rate of AccessLogSampling, if set
+//	LOG_MAX_PER_SECOND            MaxPerSecond of AccessLogSampling, if set
+//	RATE_LIMIT, RATE_LIMIT_BURST  Rate and Burst of ConfigRateLimiter, if set
+var ConfigFile string
+
+// ConfigRateLimiter, if set, has its limit set from RATE_LIMIT and
+// RATE_LIMIT_BURST at startup and on each reload.
+var ConfigRateLimiter *RateLimiter
+
+var (
+	reloadMu    sync.Mutex
+	reloadHooks []func()
+)
+
+// OnReload registers f to run when Serve reloads its configuration on one
+// of ReloadSignals, after ConfigFile has been loaded into the environment
+// and the settings Serve knows about applied. Use it to apply settings of
+// the application's own, for example
+//
+//	gracefulserver.OnReload(func() {
+//		limit, _ := strconv.Atoi(os.Getenv("QUEUE_SIZE"))
+//		queue.Resize(limit)
+//	})
+func OnReload(f func()) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	reloadHooks = append(reloadHooks, f)
+}
+
+// loadConfig loads ConfigFile and applies the settings read from the
+// environment.
+func loadConfig() {
+	if err := loadConfigFile(); err != nil {
+		errorf("Could not load config file: %v", err)
+	}
+	if level := os.Getenv("LOG_LEVEL"); level != "" {
+		if err := LogLevel.UnmarshalText([]byte(level)); err != nil {
+			errorf("Bad LOG_LEVEL: %v", err)
+		}
+	}
+	if ls := AccessLogSampling; ls != nil {
+		rate, maxPerSecond := ls.rate()
+		rate = envFloat("LOG_SAMPLE_RATE", rate)
+		maxPerSecond = envFloat("LOG_MAX_PER_SECOND", maxPerSecond)
+		ls.SetRate(rate, maxPerSecond)
+	}
+	if rl := ConfigRateLimiter; rl != nil {
+		rate, burst := rl.limit()
+		rate = envFloat("RATE_LIMIT", rate)
+		burst = int(envFloat("RATE_LIMIT_BURST", float64(burst)))
+		rl.SetLimit(rate, burst)
+	}
+}
+
+// envFloat returns the number in the environment variable key, or def if
+// it is unset or bad.
+func envFloat(key string, def float64) float64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 {
+		errorf("Bad %s: %q", key, v)
+		return def
+	}
+	return f
+}
+
+// reload reloads the configuration and TLS certificate, reopens AccessLog
+// if it can be, and runs the OnReload hooks.
+func reload(cert *certificate) {
+	loadConfig()
+	if cert != nil {
+		if err := cert.load(); err != nil {
+			errorf("Could not reload TLS certificate: %v", err)
+		}
+	}
+	if r, ok := AccessLog.(interface{ Reopen() error }); ok {
+		if err := r.Reopen(); err != nil {
+			errorf("Could not reopen access log: %v", err)
+		}
+	}
+	reloadMu.Lock()
+	hooks := reloadHooks
+	reloadMu.Unlock()
+	for _, f := range hooks {
+		f()
+	}
+	event(EventReloaded, "Configuration reloaded")
+}
+
+func loadConfigFile() error {
+	if ConfigFile == "" {
+		return nil
+	}
+	f, err := os.Open(ConfigFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		v = strings.TrimSpace(v)
+		if len(v) >= 2 && (v[0] == '"' && v[len(v)-1] == '"' || v[0] == '\'' && v[len(v)-1] == '\'') {
+			v = v[1 : len(v)-1]
+		}
+		os.Setenv(strings.TrimSpace(k), v)
+	}
+	return s.Err()
+}
+
+// certificate is a TLS certificate that can be reloaded from CertFile and
+// KeyFile while connections keep being accepted.
+type certificate struct {
+	cert atomic.Pointer[tls.Certificate]
+}
+
+func (c *certificate) load() error {
+	cert, err := tls.LoadX509KeyPair(CertFile, KeyFile)
+	if err != nil {
+		return err
+	}
+	c.cert.Store(&cert)
+	return nil
+}
+
+func (c *certificate) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.cert.Load(), nil
+}
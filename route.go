@@ -0,0 +1,58 @@
+package gracefulserver
+
+import (
+	"cmp"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// UnmatchedRoute is the Route recorded for requests no ServeMux pattern
+// matched, so stray paths don't each get their own label.
+const UnmatchedRoute = "unmatched"
+
+// RouteLabels returns mux with the pattern that matched each request, such
+// as "GET /items/{id}", recorded as the Route of its Entry. The pattern is
+// taken from r.Pattern once mux has routed the request, so middleware can
+// read it after calling the next handler, as when recording metrics. Serve
+// applies it when its handler is a ServeMux.
+func RouteLabels(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if e := EntryFromContext(r.Context()); e != nil && e.Route == "" {
+			// ServeMux sets r.Pattern on the request it is given.
+			defer func() {
+				e.Route = cmp.Or(r.Pattern, UnmatchedRoute)
+			}()
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// RouteNormalizer, if set, labels requests that RouteLabels didn't with
+// their path as normalized by it, e.g. NormalizePath.
+var RouteNormalizer func(path string) string
+
+var (
+	uuidSegment = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	hexSegment  = regexp.MustCompile(`^[0-9a-fA-F]{16,}$`)
+	numSegment  = regexp.MustCompile(`^[0-9]+$`)
+)
+
+// NormalizePath replaces the path segments of p that look like IDs with
+// placeholders: "{id}" for numbers, "{uuid}" for UUIDs and "{hash}" for
+// long hexadecimal strings. For example, "/users/42/posts" becomes
+// "/users/{id}/posts".
+func NormalizePath(p string) string {
+	segs := strings.Split(p, "/")
+	for i, seg := range segs {
+		switch {
+		case numSegment.MatchString(seg):
+			segs[i] = "{id}"
+		case uuidSegment.MatchString(seg):
+			segs[i] = "{uuid}"
+		case hexSegment.MatchString(seg):
+			segs[i] = "{hash}"
+		}
+	}
+	return strings.Join(segs, "/")
+}
@@ -0,0 +1,120 @@
+package gracefulserver
+
+import (
+	"cmp"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogSampler decides which requests Logger logs, to keep the cost of access
+// logging down under heavy traffic. Set AccessLogSampling to use it.
+type LogSampler struct {
+	// Rate is the fraction of requests logged, from 0 to 1. Zero logs
+	// every request.
+	Rate float64
+	// AlwaysLogErrors logs every request that failed with a 5xx status or
+	// was timed out by HandlerTimeout, regardless of Rate and
+	// ExcludePaths.
+	AlwaysLogErrors bool
+	// SlowThreshold, if set, logs every request that took at least that
+	// long, regardless of Rate and ExcludePaths.
+	SlowThreshold time.Duration
+	// ExcludePaths are paths that are not logged, such as health checks.
+	// Paths ending in "/" exclude everything under them.
+	ExcludePaths []string
+	// MaxPerSecond, if set, caps the access log lines written per second,
+	// with bursts of up to as many lines. Lines over the cap are dropped,
+	// even errors and slow requests.
+	MaxPerSecond float64
+	// ReportInterval is how often the number of dropped lines is
+	// reported. It defaults to one minute.
+	ReportInterval time.Duration
+
+	mu      sync.Mutex
+	tokens  float64
+	last    time.Time
+	dropped int
+	since   time.Time
+	timer   *time.Timer
+}
+
+// AccessLogSampling, if set, chooses which requests Logger logs.
+var AccessLogSampling *LogSampler
+
+// SetRate changes Rate and MaxPerSecond of a sampler that is in use. Serve
+// calls it on reload for AccessLogSampling; see ConfigFile.
+func (ls *LogSampler) SetRate(rate, maxPerSecond float64) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.Rate, ls.MaxPerSecond = rate, maxPerSecond
+}
+
+func (ls *LogSampler) rate() (rate, maxPerSecond float64) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	return ls.Rate, ls.MaxPerSecond
+}
+
+// sample reports whether e should be logged.
+func (ls *LogSampler) sample(e *Entry) bool {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	always := ls.AlwaysLogErrors && (e.Status >= 500 || e.TimedOut) ||
+		ls.SlowThreshold > 0 && e.Duration >= ls.SlowThreshold
+	if !always {
+		if ls.excluded(e.URL.Path) {
+			return false
+		}
+		if ls.Rate > 0 && rand.Float64() >= ls.Rate {
+			return false
+		}
+	}
+	return ls.take()
+}
+
+func (ls *LogSampler) excluded(path string) bool {
+	for _, p := range ls.ExcludePaths {
+		if path == p || strings.HasSuffix(p, "/") && strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// take removes a token from the line cap. ls.mu must be held.
+func (ls *LogSampler) take() bool {
+	if ls.MaxPerSecond <= 0 {
+		return true
+	}
+	now := time.Now()
+	burst := max(ls.MaxPerSecond, 1)
+	if ls.last.IsZero() {
+		ls.tokens = burst
+	} else {
+		ls.tokens = min(burst, ls.tokens+now.Sub(ls.last).Seconds()*ls.MaxPerSecond)
+	}
+	ls.last = now
+	if ls.tokens < 1 {
+		if ls.timer == nil {
+			// Report on a timer rather than on the next logged line,
+			// which may not come while the lines are being dropped.
+			ls.since = now
+			ls.timer = time.AfterFunc(cmp.Or(ls.ReportInterval, time.Minute), ls.report)
+		}
+		ls.dropped++
+		return false
+	}
+	ls.tokens--
+	return true
+}
+
+// report warns of the lines dropped since the first one.
+func (ls *LogSampler) report() {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	warnf("Access log dropped %d lines in the last %v", ls.dropped, time.Since(ls.since).Round(time.Second))
+	ls.dropped = 0
+	ls.timer = nil
+}
@@ -0,0 +1,149 @@
+package gracefulserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// SecurityHeaders is middleware that sets security related response
+// headers. Empty fields are not sent. Start from StrictSecurityHeaders or
+// APISecurityHeaders and add its Wrap method to Middleware to use it.
+type SecurityHeaders struct {
+	// HSTS is the Strict-Transport-Security header. It is only sent on
+	// requests that reached the server, or a trusted proxy, over HTTPS.
+	HSTS string
+	// ContentTypeOptions is the X-Content-Type-Options header.
+	ContentTypeOptions string
+	// FrameOptions is the X-Frame-Options header.
+	FrameOptions string
+	// ReferrerPolicy is the Referrer-Policy header.
+	ReferrerPolicy string
+	// PermissionsPolicy is the Permissions-Policy header.
+	PermissionsPolicy string
+	// CSP is the Content-Security-Policy header. Each "{nonce}" in it is
+	// replaced by a fresh nonce per request, available to handlers from
+	// CSPNonce.
+	CSP string
+	// CSPReportOnly sends CSP as Content-Security-Policy-Report-Only
+	// instead, so violations are reported but not blocked.
+	CSPReportOnly bool
+	// CSPReportPath, if set, is a path that accepts CSP violation reports
+	// and logs them. It is added to CSP as its report-uri.
+	CSPReportPath string
+}
+
+// StrictSecurityHeaders is a preset for sites serving HTML. Its CSP only
+// allows scripts from the same origin or with the request's nonce.
+var StrictSecurityHeaders = SecurityHeaders{
+	HSTS:               "max-age=63072000; includeSubDomains",
+	ContentTypeOptions: "nosniff",
+	FrameOptions:       "DENY",
+	ReferrerPolicy:     "strict-origin-when-cross-origin",
+	PermissionsPolicy:  "camera=(), microphone=(), geolocation=(), payment=()",
+	CSP: "default-src 'self'; script-src 'self' 'nonce-{nonce}'; " +
+		"style-src 'self' 'nonce-{nonce}'; object-src 'none'; " +
+		"base-uri 'self'; frame-ancestors 'none'",
+}
+
+// APISecurityHeaders is a preset for services that only serve data. Its
+// CSP forbids loading anything.
+var APISecurityHeaders = SecurityHeaders{
+	HSTS:               "max-age=63072000; includeSubDomains",
+	ContentTypeOptions: "nosniff",
+	FrameOptions:       "DENY",
+	ReferrerPolicy:     "no-referrer",
+	CSP:                "default-src 'none'; frame-ancestors 'none'",
+}
+
+type nonceKey struct{}
+
+// CSPNonce returns the nonce SecurityHeaders put in the request's
+// Content-Security-Policy, for use in script and style tags.
+func CSPNonce(ctx context.Context) string {
+	nonce, _ := ctx.Value(nonceKey{}).(string)
+	return nonce
+}
+
+// Wrap returns next with security headers added to its responses.
+func (sh *SecurityHeaders) Wrap(next http.Handler) http.Handler {
+	csp := sh.CSP
+	if csp != "" && sh.CSPReportPath != "" && !strings.Contains(csp, "report-uri") {
+		csp += "; report-uri " + sh.CSPReportPath
+	}
+	cspHeader := "Content-Security-Policy"
+	if sh.CSPReportOnly {
+		cspHeader = "Content-Security-Policy-Report-Only"
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sh.CSPReportPath != "" && r.URL.Path == sh.CSPReportPath {
+			serveCSPReport(w, r)
+			return
+		}
+		h := w.Header()
+		if sh.HSTS != "" && isHTTPS(r) {
+			h.Set("Strict-Transport-Security", sh.HSTS)
+		}
+		setNonEmpty(h, "X-Content-Type-Options", sh.ContentTypeOptions)
+		setNonEmpty(h, "X-Frame-Options", sh.FrameOptions)
+		setNonEmpty(h, "Referrer-Policy", sh.ReferrerPolicy)
+		setNonEmpty(h, "Permissions-Policy", sh.PermissionsPolicy)
+		if strings.Contains(csp, "{nonce}") {
+			var b [16]byte
+			rand.Read(b[:])
+			nonce := base64.StdEncoding.EncodeToString(b[:])
+			h.Set(cspHeader, strings.ReplaceAll(csp, "{nonce}", nonce))
+			r = r.WithContext(context.WithValue(r.Context(), nonceKey{}, nonce))
+		} else {
+			setNonEmpty(h, cspHeader, csp)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func setNonEmpty(h http.Header, key, value string) {
+	if value != "" {
+		h.Set(key, value)
+	}
+}
+
+func isHTTPS(r *http.Request) bool {
+	if ci, ok := ClientFromContext(r.Context()); ok {
+		return ci.Scheme == "https"
+	}
+	return r.TLS != nil
+}
+
+// maxCSPReportLog is how much of a CSP report is logged. Anyone can post
+// reports, so they are cut short to keep them from flooding the log.
+const maxCSPReportLog = 512
+
+// serveCSPReport logs a CSP violation report sent by a browser.
+func serveCSPReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 64<<10))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, body); err != nil {
+		http.Error(w, "malformed report", http.StatusBadRequest)
+		return
+	}
+	report := buf.String()
+	if len(report) > maxCSPReportLog {
+		report = report[:maxCSPReportLog] + "..."
+	}
+	warnf("CSP violation from %.200q: %s", r.UserAgent(), report)
+	w.WriteHeader(http.StatusNoContent)
+}
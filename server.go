@@ -2,62 +2,292 @@ package gracefulserver
 
 import (
 	"context"
-	"log"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
-	"syscall"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 )
 
 // Serve starts an HTTP listener on the port specified by environmental
-// variable PORT (8080 if not set). Requests
-// will be logged by the Logger middleware. Serve blocks until SIGINT or
-// SIGTERM is received and the listener is closed.
+// variable PORT (8080 if not set). If CertFile and KeyFile are set, the
+// listener uses TLS, a second listener on RedirectAddr redirects plain HTTP
+// requests to it, and HTTP3 can add HTTP/3 on the same port. Otherwise, H2C
+// allows cleartext HTTP/2. gRPC requests go to GRPC if set; other requests
+// pass through Middleware and will be logged by the Logger middleware.
+// Serve blocks until one of ShutdownSignals (SIGINT or SIGTERM by default)
+// is received and the listeners are closed. See ReloadSignals, StopSignals
+// and SignalHandlers for the other signals it handles.
 func Serve(handler http.Handler) {
+	ServeContext(context.Background(), handler)
+}
+
+// ErrStop is a cancellation cause that makes ServeContext stop
+// immediately instead of gracefully:
+//
+//	ctx, cancel := context.WithCancelCause(ctx)
+//	go gracefulserver.ServeContext(ctx, handler)
+//	// ...
+//	cancel(gracefulserver.ErrStop)
+var ErrStop = errors.New("gracefulserver: immediate stop")
+
+// ServeContext is like Serve, but it also shuts down gracefully when ctx is
+// canceled, or immediately if the cause is ErrStop. With DisableSignals set,
+// this lets the host application own signal handling. It returns the first
+// error that stopped a listener other than http.ErrServerClosed.
+func ServeContext(ctx context.Context, handler http.Handler) error {
+	loadConfig()
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
+	ln, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		errorf("Could not listen: %v", err)
+		return err
+	}
+	return serve(ctx, ln, handler, !DisableSignals)
+}
 
-	// subscribe to SIGINT signals
-	stopChan := make(chan os.Signal, 1)
-	signal.Notify(stopChan, syscall.SIGINT, syscall.SIGTERM)
+// ServeListener is like ServeContext, but it serves on ln instead of
+// listening on PORT and never handles signals.
+func ServeListener(ctx context.Context, ln net.Listener, handler http.Handler) error {
+	loadConfig()
+	return serve(ctx, ln, handler, false)
+}
+
+func serve(ctx context.Context, ln net.Listener, handler http.Handler, signals bool) error {
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	// subscribe to signals
+	sigc := make(chan os.Signal, 1)
+	if sigs := handledSignals(); signals && len(sigs) > 0 {
+		signal.Notify(sigc, sigs...)
+		defer signal.Stop(sigc)
+	}
+
+	if mux, ok := handler.(*http.ServeMux); ok {
+		handler = RouteLabels(mux)
+		if mux == http.DefaultServeMux {
+			handler = guardDebug(handler)
+		}
+	}
+	for i := len(Middleware) - 1; i >= 0; i-- {
+		handler = Middleware[i](handler)
+	}
+	useTLS := CertFile != "" && KeyFile != ""
+	var tlsConfig *tls.Config
+	var cert *certificate
+	if useTLS {
+		cert = new(certificate)
+		if err := cert.load(); err != nil {
+			errorf("Could not load TLS certificate: %v", err)
+			ln.Close()
+			return err
+		}
+		tlsConfig = &tls.Config{GetCertificate: cert.get}
+		if Redirects.Host != "" || Redirects.TrailingSlash != SlashAsIs {
+			handler = Redirects.Wrap(handler)
+		}
+	}
+	if GRPC != nil {
+		handler = routeGRPC(GRPC, handler)
+	}
+	srv := &http.Server{
+		Addr:        ln.Addr().String(),
+		Handler:     Logger(handler),
+		TLSConfig:   tlsConfig,
+		IdleTimeout: IdleTimeout,
+		HTTP2:       HTTP2,
+		ConnState:   conns.track,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, connKey{}, c)
+		},
+	}
+	if H2C && !useTLS {
+		// Shutdown sends GOAWAY on HTTP/2 connections, cleartext or not.
+		srv.Protocols = new(http.Protocols)
+		srv.Protocols.SetHTTP1(true)
+		srv.Protocols.SetUnencryptedHTTP2(true)
+	}
 
-	srv := &http.Server{Addr: ":" + port, Handler: Logger(handler)}
+	servers := []interface{ Shutdown(context.Context) error }{srv}
+	errc := make(chan error, 4)
+	if useTLS && HTTP3 != nil {
+		h3 := HTTP3(srv.Addr, tlsConfig.Clone(), srv.Handler)
+		servers = append(servers, h3)
+		srv.Handler = Logger(altSvc(port, handler))
+		go func() {
+			event(EventListening, "Begin listening for HTTP/3 on UDP port %s", port)
+			errc <- h3.ListenAndServe()
+		}()
+	}
 
-	errc := make(chan error)
 	go func() {
-		log.Printf("Begin listening on port %s", port)
+		ln := ln
+		if WrapListener != nil {
+			ln = WrapListener(ln)
+		}
+		event(EventListening, "Begin listening on port %s", port)
 		// service connections
-		errc <- srv.ListenAndServe()
+		if useTLS {
+			errc <- srv.ServeTLS(ln, "", "")
+		} else {
+			errc <- srv.Serve(ln)
+		}
 	}()
 
-	<-stopChan // wait for system signal
-	log.Println("Shutting down server...")
+	// The redirect listener is not in errc, since its failure isn't fatal.
+	redirects := 0
+	if useTLS && RedirectAddr != "" {
+		redirect := &http.Server{
+			Addr:    RedirectAddr,
+			Handler: Logger(Redirects.toHTTPS(port)),
+		}
+		servers = append(servers, redirect)
+		redirects = 1
+		go func() {
+			event(EventListening, "Begin redirecting HTTP on %s", RedirectAddr)
+			err := redirect.ListenAndServe()
+			if errors.Is(err, http.ErrServerClosed) {
+				event(EventFinished, "Finished redirecting: %v", err)
+				return
+			}
+			// The TLS listener keeps serving without it, e.g. when the
+			// process may not bind port 80.
+			errorf("Could not redirect HTTP on %s: %v", RedirectAddr, err)
+		}()
+	}
+
+	if AdminAddr != "" {
+		admin := &http.Server{Addr: adminAddr(), Handler: AdminMux}
+		servers = append(servers, admin)
+		go func() {
+			event(EventListening, "Begin admin listener on %s", admin.Addr)
+			errc <- admin.ListenAndServe()
+		}()
+	}
+
+	var firstErr error
+	finished := func(err error) {
+		event(EventFinished, "Finished listening: %v", err)
+		if firstErr == nil && !errors.Is(err, http.ErrServerClosed) {
+			firstErr = err
+		}
+	}
+
+	running := len(servers) - redirects
+	immediate := false
+serve:
+	for {
+		select {
+		case sig := <-sigc: // wait for system signal
+			switch {
+			case slices.Contains(ShutdownSignals, sig):
+				break serve
+			case slices.Contains(StopSignals, sig):
+				immediate = true
+				break serve
+			case slices.Contains(ReloadSignals, sig):
+				reload(cert)
+			default:
+				if f := SignalHandlers[sig]; f != nil {
+					f()
+				}
+			}
+		case <-ctx.Done():
+			immediate = errors.Is(context.Cause(ctx), ErrStop)
+			break serve
+		case err := <-errc:
+			finished(err)
+			running--
+			break serve
+		}
+	}
 
 	// shut down gracefully, but wait no longer than 5 seconds before halting
-	ctx, c := context.WithTimeout(context.Background(), Timeout)
+	shutdownCtx, c := context.WithTimeout(context.Background(), Timeout)
 	defer c()
-	srv.Shutdown(ctx)
+	if immediate {
+		event(EventStopping, "Stopping server immediately...")
+		for _, srv := range servers {
+			if closer, ok := srv.(interface{ Close() error }); ok {
+				closer.Close()
+			} else {
+				// Shutdown closes listeners before it checks the context.
+				canceled, cancel := context.WithCancel(context.Background())
+				cancel()
+				srv.Shutdown(canceled)
+			}
+		}
+	} else {
+		event(EventShuttingDown, "Shutting down server...")
+		var wg sync.WaitGroup
+		for _, srv := range servers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				srv.Shutdown(shutdownCtx)
+			}()
+		}
+		wg.Wait()
+	}
+	if GRPC != nil {
+		// Its streams were drained along with the HTTP/2 connections
+		// carrying them; stop whatever outlived the deadline.
+		GRPC.Stop()
+	}
 
-	select {
-	case err := <-errc:
-		log.Printf("Finished listening: %v\n", err)
-	case <-ctx.Done():
-		log.Println("Graceful shutdown timed out")
+wait:
+	for ; running > 0; running-- {
+		select {
+		case err := <-errc:
+			finished(err)
+		case <-shutdownCtx.Done():
+			event(EventTimedOut, "Graceful shutdown timed out")
+			break wait
+		}
 	}
 
-	log.Println("Server stopped")
+	slow.report()
+	if f, ok := AccessLog.(interface{ Flush() error }); ok {
+		if err := f.Flush(); err != nil {
+			errorf("Could not flush access log: %v", err)
+		}
+	}
+	event(EventStopped, "Server stopped")
+	return firstErr
 }
 
 // Logger is the logging middleware for gracefulserver. By default it logs the
-// URL, UserAgent, and duration of requests with Go standard logger.
+// URL, UserAgent, duration, status and size of requests with Go standard
+// logger, along with anything middleware added to the request's Entry.
 var Logger = func(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
-		next.ServeHTTP(w, r)
-		log.Printf("Served %s for %q in %v", r.URL, r.UserAgent(), time.Since(start))
+		e := &Entry{URL: r.URL, UserAgent: r.UserAgent()}
+		r = r.WithContext(context.WithValue(r.Context(), entryKey{}, e))
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = &countingBody{r.Body, e}
+		}
+		// Log from a defer so requests aborted with http.ErrAbortHandler
+		// are still logged.
+		stopWatch := slow.watch(r, e, start)
+		defer func() {
+			stopWatch()
+			e.Duration = time.Since(start)
+			if e.Status == 0 {
+				e.Status = http.StatusOK
+			}
+			logAccess(e)
+		}()
+		next.ServeHTTP(&responseWriter{w, e}, r)
 	})
 
 }
@@ -65,4 +295,87 @@ var Logger = func(next http.Handler) http.Handler {
 var (
 	// Timeout is the amount of time the server will wait for requests to finish during shutdown
 	Timeout = 5 * time.Second
+	// Middleware is applied to the handler passed to Serve, inside Logger.
+	// The first entry is the outermost.
+	Middleware []func(http.Handler) http.Handler
+	// WrapListener, if set, wraps the listener opened by Serve, e.g. with
+	// ProxyProtocol.Listener.
+	WrapListener func(net.Listener) net.Listener
+	// CertFile and KeyFile, if both set, are the TLS certificate and key
+	// used by Serve.
+	CertFile, KeyFile string
+	// RedirectAddr is where Serve listens for plain HTTP requests to
+	// redirect to HTTPS when TLS is enabled. Set it to "" to disable. If
+	// it can't be listened on, the error is logged and the TLS listener
+	// serves alone.
+	RedirectAddr = ":80"
+	// Redirects is the canonical host and trailing slash policy applied
+	// when TLS is enabled, both by the redirect listener and on the TLS
+	// listener itself.
+	Redirects RedirectPolicy
+	// H2C enables HTTP/2 with prior knowledge on the listener when TLS is
+	// not used, e.g. behind a load balancer that terminates TLS.
+	H2C bool
+	// HTTP2 tunes HTTP/2 connections, such as the maximum concurrent
+	// streams and frame size. If nil, the net/http defaults are used.
+	HTTP2 *http.HTTP2Config
+	// IdleTimeout is how long keep-alive connections, including HTTP/2
+	// connections, may sit idle. Zero means no limit.
+	IdleTimeout time.Duration
+	// HTTP3, if set, is called when TLS is enabled to create an HTTP/3
+	// server for the UDP port matching the TLS listener. TCP responses
+	// then advertise it with an Alt-Svc header.
+	HTTP3 func(addr string, config *tls.Config, handler http.Handler) HTTP3Server
+	// GRPC, if set, handles gRPC requests on the same port as the handler
+	// passed to Serve, bypassing Middleware. gRPC needs HTTP/2, so either
+	// TLS or H2C must be enabled.
+	GRPC GRPCServer
+	// AdminAddr, if set, is where Serve starts a second listener for
+	// AdminMux. If it has no host, as in ":6060", it binds to localhost.
+	AdminAddr string
 )
+
+// HTTP3Server is an HTTP/3 server, such as *http3.Server from
+// github.com/quic-go/quic-go/http3:
+//
+//	gracefulserver.HTTP3 = func(addr string, config *tls.Config, handler http.Handler) gracefulserver.HTTP3Server {
+//		return &http3.Server{Addr: addr, TLSConfig: config, Handler: handler}
+//	}
+type HTTP3Server interface {
+	ListenAndServe() error
+	Shutdown(ctx context.Context) error
+}
+
+// GRPCServer is a gRPC server that can serve requests through net/http,
+// such as *grpc.Server from google.golang.org/grpc.
+//
+// Serve does not call GracefulStop, which *grpc.Server does not support
+// for streams served this way. Instead, streams are drained along with the
+// HTTP/2 connections carrying them and Stop is called once Shutdown
+// finishes or Timeout passes.
+type GRPCServer interface {
+	http.Handler
+	Stop()
+}
+
+// routeGRPC sends gRPC requests to grpc and everything else to next.
+func routeGRPC(grpc GRPCServer, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			grpc.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// altSvc advertises HTTP/3 on port.
+func altSvc(port string, next http.Handler) http.Handler {
+	value := fmt.Sprintf(`h3=":%s"; ma=86400`, port)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Alt-Svc", value)
+		next.ServeHTTP(w, r)
+	})
+}
+
+type connKey struct{}
@@ -0,0 +1,34 @@
+package gracefulserver
+
+import (
+	"os"
+	"syscall"
+)
+
+var (
+	// ShutdownSignals make Serve shut down gracefully.
+	ShutdownSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+	// StopSignals make Serve close its listeners and connections at once,
+	// without waiting for requests to finish.
+	StopSignals []os.Signal
+	// ReloadSignals make Serve reload its configuration.
+	ReloadSignals = []os.Signal{syscall.SIGHUP}
+	// SignalHandlers are called by Serve when it receives other signals,
+	// such as SIGUSR1 to dump state. They run on Serve's goroutine, so
+	// they should return promptly.
+	SignalHandlers map[os.Signal]func()
+	// DisableSignals stops Serve from handling signals at all, leaving
+	// them to the host application. Use ServeContext to shut it down.
+	DisableSignals bool
+)
+
+func handledSignals() []os.Signal {
+	var sigs []os.Signal
+	sigs = append(sigs, ShutdownSignals...)
+	sigs = append(sigs, StopSignals...)
+	sigs = append(sigs, ReloadSignals...)
+	for sig := range SignalHandlers {
+		sigs = append(sigs, sig)
+	}
+	return sigs
+}
@@ -0,0 +1,169 @@
+package gracefulserver
+
+import (
+	"bytes"
+	"net/http"
+	"runtime"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// SlowThreshold, if set, is how long a request may run before Logger
+	// warns about it while it is still running. Slow requests are listed
+	// at /debug/slow on AdminMux and reported when Serve shuts down.
+	SlowThreshold time.Duration
+	// SlowStacks adds the stack of the goroutine handling a slow request,
+	// taken when it crossed SlowThreshold, to its warning. The stack is
+	// of the goroutine Logger runs in, so it doesn't show where a handler
+	// is stuck if middleware runs it in a goroutine of its own, as
+	// HandlerTimeout does.
+	SlowStacks bool
+)
+
+// SlowRequest describes a request that ran past SlowThreshold.
+type SlowRequest struct {
+	Method     string        `json:"method"`
+	URL        string        `json:"url"`
+	RemoteAddr string        `json:"remote_addr"`
+	Start      time.Time     `json:"start"`
+	Duration   time.Duration `json:"duration"`
+	Running    bool          `json:"running"`
+	Stack      string        `json:"stack,omitempty"`
+}
+
+// maxRecentSlow is the number of finished slow requests kept for
+// /debug/slow.
+const maxRecentSlow = 50
+
+type slowRequests struct {
+	mu      sync.Mutex
+	running map[*SlowRequest]struct{}
+	recent  []SlowRequest
+}
+
+var slow = &slowRequests{running: make(map[*SlowRequest]struct{})}
+
+// watch warns about r if it is still running after SlowThreshold. The
+// returned function must be called when r finishes.
+func (sr *slowRequests) watch(r *http.Request, e *Entry, start time.Time) func() {
+	threshold := SlowThreshold
+	if threshold <= 0 {
+		return func() {}
+	}
+	var gid string
+	if SlowStacks {
+		gid = goroutineID()
+	}
+	req := &SlowRequest{
+		Method:     r.Method,
+		URL:        redactURL(r.URL).String(),
+		RemoteAddr: r.RemoteAddr,
+		Start:      start,
+		Running:    true,
+	}
+	fired := make(chan struct{})
+	t := time.AfterFunc(threshold, func() {
+		defer close(fired)
+		if gid != "" {
+			req.Stack = goroutineStack(gid)
+		}
+		sr.mu.Lock()
+		sr.running[req] = struct{}{}
+		sr.mu.Unlock()
+		if req.Stack != "" {
+			warnf("Slow request %s %s from %s running for %v:\n%s",
+				req.Method, req.URL, req.RemoteAddr, threshold, req.Stack)
+		} else {
+			warnf("Slow request %s %s from %s running for %v",
+				req.Method, req.URL, req.RemoteAddr, threshold)
+		}
+	})
+	return func() {
+		if t.Stop() {
+			return
+		}
+		<-fired
+		e.Slow = true
+		sr.mu.Lock()
+		defer sr.mu.Unlock()
+		delete(sr.running, req)
+		done := *req
+		done.Running = false
+		done.Duration = time.Since(start)
+		if len(sr.recent) == maxRecentSlow {
+			sr.recent = slices.Delete(sr.recent, 0, 1)
+		}
+		sr.recent = append(sr.recent, done)
+	}
+}
+
+// list returns the slow requests still running, oldest first, followed by
+// the recent ones that finished.
+func (sr *slowRequests) list() (running, recent []SlowRequest) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	for req := range sr.running {
+		r := *req
+		r.Duration = time.Since(r.Start)
+		running = append(running, r)
+	}
+	slices.SortFunc(running, func(a, b SlowRequest) int {
+		return a.Start.Compare(b.Start)
+	})
+	return running, slices.Clone(sr.recent)
+}
+
+// report warns about slow requests that are still running, for when the
+// server stops.
+func (sr *slowRequests) report() {
+	running, _ := sr.list()
+	for _, r := range running {
+		warnf("Slow request %s %s from %s still running after %v",
+			r.Method, r.URL, r.RemoteAddr, r.Duration.Round(time.Millisecond))
+	}
+}
+
+func serveSlow(w http.ResponseWriter, r *http.Request) {
+	running, recent := slow.list()
+	writeJSON(w, map[string]any{
+		"threshold": SlowThreshold.String(),
+		"running":   running,
+		"recent":    recent,
+	})
+}
+
+// goroutineID returns the ID of the calling goroutine, as it appears in
+// stack traces.
+func goroutineID() string {
+	var buf [64]byte
+	b := buf[:runtime.Stack(buf[:], false)]
+	b = bytes.TrimPrefix(b, []byte("goroutine "))
+	id, _, _ := bytes.Cut(b, []byte(" "))
+	if _, err := strconv.ParseUint(string(id), 10, 64); err != nil {
+		return ""
+	}
+	return string(id)
+}
+
+// goroutineStack returns the stack of the goroutine with ID id.
+func goroutineStack(id string) string {
+	buf := make([]byte, 64<<10)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	prefix := []byte("goroutine " + id + " ")
+	for g := range bytes.SplitSeq(buf, []byte("\n\n")) {
+		if bytes.HasPrefix(g, prefix) {
+			return string(g)
+		}
+	}
+	return ""
+}
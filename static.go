@@ -0,0 +1,258 @@
+package gracefulserver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Static serves files from an fs.FS, such as an embed.FS. Files with a
+// precompressed variant next to them, named with a .br or .gz suffix, are
+// served in whichever encoding the client prefers. Every file gets a strong
+// ETag computed by NewStatic.
+//
+// Use it as a handler, or add its Wrap method to Middleware to serve files
+// in front of the application's own handler.
+type Static struct {
+	// SPA serves /index.html for GET requests that accept HTML and name no
+	// file, so a single page app can do its own routing. Under Wrap, it
+	// only does so when the wrapped handler responds with a 404.
+	SPA bool
+	// Hashed matches the paths of files with a content hash in their name,
+	// which are served with ImmutableCacheControl. It defaults to names
+	// with 8 or more hex digits before the extension, like
+	// "app.3f2a9c1b.js".
+	Hashed *regexp.Regexp
+	// CacheControl is the Cache-Control header for other files. It
+	// defaults to "no-cache", so clients revalidate them with the ETag.
+	CacheControl string
+
+	fsys  fs.FS
+	files map[string]*staticFile
+}
+
+// ImmutableCacheControl is the Cache-Control header Static sends for
+// hashed files.
+const ImmutableCacheControl = "public, max-age=31536000, immutable"
+
+var defaultHashed = regexp.MustCompile(`[.-][0-9a-fA-F]{8,}\.[^./]+$`)
+
+// staticEncodings are the precompressed variants Static looks for, by
+// content coding, in order of preference.
+var staticEncodings = []struct{ name, ext string }{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+type staticFile struct {
+	name        string
+	contentType string
+	etag        string
+	modTime     time.Time
+	variants    map[string]*staticFile
+}
+
+// NewStatic returns a Static serving fsys. It reads every file in fsys to
+// compute its ETag.
+func NewStatic(fsys fs.FS) (*Static, error) {
+	s := &Static{fsys: fsys, files: make(map[string]*staticFile)}
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		b, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(b)
+		contentType := mime.TypeByExtension(path.Ext(name))
+		if contentType == "" {
+			contentType = http.DetectContentType(b)
+		}
+		s.files[name] = &staticFile{
+			name:        name,
+			contentType: contentType,
+			etag:        `"` + base64.RawURLEncoding.EncodeToString(sum[:16]) + `"`,
+			modTime:     info.ModTime(),
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for name, f := range s.files {
+		for _, enc := range staticEncodings {
+			if v := s.files[name+enc.ext]; v != nil {
+				if f.variants == nil {
+					f.variants = make(map[string]*staticFile)
+				}
+				f.variants[enc.name] = v
+			}
+		}
+	}
+	return s, nil
+}
+
+// lookup finds the file for a request path, or the index.html of a
+// directory.
+func (s *Static) lookup(urlPath string) *staticFile {
+	name := strings.TrimPrefix(path.Clean("/"+urlPath), "/")
+	if f := s.files[name]; f != nil {
+		return f
+	}
+	return s.files[path.Join(name, "index.html")]
+}
+
+// fallback returns index.html for requests a single page app routes.
+func (s *Static) fallback(r *http.Request) *staticFile {
+	if !s.SPA || path.Ext(r.URL.Path) != "" || !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		return nil
+	}
+	return s.files["index.html"]
+}
+
+// ServeHTTP serves the file named by the request path.
+func (s *Static) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	f := s.lookup(r.URL.Path)
+	if f == nil {
+		f = s.fallback(r)
+	}
+	if f == nil {
+		http.NotFound(w, r)
+		return
+	}
+	s.serve(w, r, f)
+}
+
+// Wrap returns next with GET and HEAD requests for files in the Static
+// served from it instead. With SPA set, index.html is only served for
+// requests that next answers with a 404.
+func (s *Static) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if f := s.lookup(r.URL.Path); f != nil {
+			s.serve(w, r, f)
+			return
+		}
+		index := s.fallback(r)
+		if index == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		nw := &notFoundWriter{ResponseWriter: w}
+		next.ServeHTTP(nw, r)
+		if nw.notFound {
+			for _, k := range []string{"Content-Length", "Content-Encoding", "X-Content-Type-Options"} {
+				w.Header().Del(k)
+			}
+			s.serve(w, r, index)
+		}
+	})
+}
+
+// notFoundWriter discards a 404 response, so that it can be replaced.
+type notFoundWriter struct {
+	http.ResponseWriter
+	wroteHeader, notFound bool
+}
+
+func (nw *notFoundWriter) WriteHeader(code int) {
+	if !nw.wroteHeader && code == http.StatusNotFound {
+		nw.wroteHeader, nw.notFound = true, true
+		return
+	}
+	if code >= 200 {
+		nw.wroteHeader = true
+	}
+	nw.ResponseWriter.WriteHeader(code)
+}
+
+func (nw *notFoundWriter) Write(b []byte) (int, error) {
+	if nw.notFound {
+		return len(b), nil
+	}
+	nw.wroteHeader = true
+	return nw.ResponseWriter.Write(b)
+}
+
+func (nw *notFoundWriter) Flush() {
+	if !nw.notFound {
+		http.NewResponseController(nw.ResponseWriter).Flush()
+	}
+}
+
+func (nw *notFoundWriter) Unwrap() http.ResponseWriter {
+	return nw.ResponseWriter
+}
+
+func (s *Static) serve(w http.ResponseWriter, r *http.Request, f *staticFile) {
+	h := w.Header()
+	rep := f
+	if len(f.variants) > 0 {
+		h.Add("Vary", "Accept-Encoding")
+		pref := make([]string, len(staticEncodings))
+		for i, enc := range staticEncodings {
+			pref[i] = enc.name
+		}
+		enc := negotiateEncoding(r.Header.Get("Accept-Encoding"), pref, func(name string) bool {
+			return f.variants[name] != nil
+		})
+		if enc != "" {
+			rep = f.variants[enc]
+			h.Set("Content-Encoding", enc)
+		}
+	}
+	h.Set("Content-Type", f.contentType)
+	h.Set("ETag", rep.etag)
+	hashed := s.Hashed
+	if hashed == nil {
+		hashed = defaultHashed
+	}
+	switch {
+	case hashed.MatchString(f.name):
+		h.Set("Cache-Control", ImmutableCacheControl)
+	case s.CacheControl != "":
+		h.Set("Cache-Control", s.CacheControl)
+	default:
+		h.Set("Cache-Control", "no-cache")
+	}
+
+	file, err := s.fsys.Open(rep.name)
+	if err != nil {
+		errorf("Could not open static file %s: %v", rep.name, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+	content, ok := file.(io.ReadSeeker)
+	if !ok {
+		b, err := io.ReadAll(file)
+		if err != nil {
+			errorf("Could not read static file %s: %v", rep.name, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		content = bytes.NewReader(b)
+	}
+	http.ServeContent(w, r, f.name, f.modTime, content)
+}
@@ -0,0 +1,235 @@
+package gracefulserver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HandlerTimeout is middleware that limits how long a handler may run. The
+// request context gets a deadline, and if the handler hasn't finished by
+// then the client gets Status and Body instead. Responses are buffered
+// until the handler flushes; once a handler starts streaming its status
+// can no longer be changed, so on timeout the context is canceled and the
+// response is left to end when the handler returns. Add its Wrap method to
+// Middleware to use it.
+type HandlerTimeout struct {
+	// Timeout is the default time limit. Zero means no limit.
+	Timeout time.Duration
+	// Routes overrides Timeout for request paths starting with a prefix.
+	// The longest matching prefix wins. A negative value means no limit.
+	Routes map[string]time.Duration
+	// Status is sent on timeout. It defaults to 503; 504 is also common.
+	Status int
+	// Body is sent on timeout. It defaults to the status text.
+	Body string
+}
+
+func (ht *HandlerTimeout) timeout(path string) time.Duration {
+	timeout, best := ht.Timeout, -1
+	for prefix, d := range ht.Routes {
+		if strings.HasPrefix(path, prefix) && len(prefix) > best {
+			timeout, best = d, len(prefix)
+		}
+	}
+	return timeout
+}
+
+// Wrap returns next with a time limit.
+func (ht *HandlerTimeout) Wrap(next http.Handler) http.Handler {
+	status := ht.Status
+	if status == 0 {
+		status = http.StatusServiceUnavailable
+	}
+	body := ht.Body
+	if body == "" {
+		body = http.StatusText(status)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout := ht.timeout(r.URL.Path)
+		if timeout <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		parent := r.Context()
+		ctx, cancel := context.WithTimeout(parent, timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+
+		tw := &timeoutWriter{w: w, h: make(http.Header)}
+		done := make(chan struct{})
+		panicc := make(chan any, 1)
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					tw.mu.Lock()
+					defer tw.mu.Unlock()
+					if !tw.timedOut {
+						panicc <- p
+					} else if p != http.ErrAbortHandler {
+						// The client already has the timeout response and
+						// nothing waits on panicc.
+						errorf("Panic serving %s %s after it timed out: %v\n%s",
+							r.Method, redactURL(r.URL), p, debug.Stack())
+					}
+				}
+			}()
+			next.ServeHTTP(tw, r)
+			close(done)
+		}()
+
+		select {
+		case p := <-panicc:
+			panic(p)
+		case <-done:
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+			tw.commit()
+		case <-ctx.Done():
+			if !errors.Is(ctx.Err(), context.DeadlineExceeded) || parent.Err() != nil {
+				// The client went away or the server is shutting down,
+				// which is no timeout: let the handler finish and send
+				// whatever it wrote.
+				select {
+				case p := <-panicc:
+					panic(p)
+				case <-done:
+				}
+				tw.mu.Lock()
+				defer tw.mu.Unlock()
+				tw.commit()
+				return
+			}
+			if e := EntryFromContext(r.Context()); e != nil {
+				e.TimedOut = true
+			}
+			tw.mu.Lock()
+			if tw.committed {
+				// Streaming: the handler owns the response until it returns.
+				tw.mu.Unlock()
+				select {
+				case p := <-panicc:
+					panic(p)
+				case <-done:
+				}
+				return
+			}
+			tw.timedOut = true
+			tw.mu.Unlock()
+			select {
+			case p := <-panicc:
+				// It panicked before the timeout took effect.
+				panic(p)
+			default:
+			}
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(status)
+			w.Write([]byte(body))
+		}
+	})
+}
+
+// timeoutWriter buffers a response until the handler finishes or flushes.
+type timeoutWriter struct {
+	w http.ResponseWriter
+	h http.Header
+
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	status    int
+	committed bool
+	timedOut  bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.h
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut || tw.status != 0 {
+		return
+	}
+	if code < 200 {
+		// Informational responses can't be taken back, but don't need to be.
+		copyHeader(tw.w.Header(), tw.h)
+		tw.w.WriteHeader(code)
+		return
+	}
+	tw.status = code
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if tw.status == 0 {
+		tw.status = http.StatusOK
+	}
+	if tw.committed {
+		return tw.w.Write(b)
+	}
+	return tw.buf.Write(b)
+}
+
+func (tw *timeoutWriter) Flush() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return
+	}
+	tw.commit()
+	http.NewResponseController(tw.w).Flush()
+}
+
+// Hijack takes over the connection, after sending anything buffered. The
+// handler then owns the connection, so no timeout response is sent.
+func (tw *timeoutWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return nil, nil, http.ErrHandlerTimeout
+	}
+	if tw.status != 0 || tw.buf.Len() > 0 {
+		tw.commit()
+	}
+	tw.committed = true
+	return http.NewResponseController(tw.w).Hijack()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, e.g. to
+// set deadlines.
+func (tw *timeoutWriter) Unwrap() http.ResponseWriter {
+	return tw.w
+}
+
+// commit sends the buffered response. Callers must hold tw.mu.
+func (tw *timeoutWriter) commit() {
+	if tw.committed {
+		return
+	}
+	tw.committed = true
+	copyHeader(tw.w.Header(), tw.h)
+	if tw.status == 0 {
+		tw.status = http.StatusOK
+	}
+	tw.w.WriteHeader(tw.status)
+	tw.w.Write(tw.buf.Bytes())
+	tw.buf.Reset()
+}
+
+func copyHeader(dst, src http.Header) {
+	for k, v := range src {
+		dst[k] = v
+	}
+}
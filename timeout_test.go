@@ -0,0 +1,173 @@
+package gracefulserver
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandlerTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		ht       HandlerTimeout
+		canceled bool
+		handler  func(w http.ResponseWriter, r *http.Request, release <-chan struct{})
+		status   int
+		body     string
+		timedOut bool
+	}{
+		{
+			name: "buffered in time",
+			ht:   HandlerTimeout{Timeout: time.Hour},
+			handler: func(w http.ResponseWriter, r *http.Request, release <-chan struct{}) {
+				w.Header().Set("X-Test", "yes")
+				w.WriteHeader(http.StatusCreated)
+				io.WriteString(w, "ok")
+			},
+			status: http.StatusCreated,
+			body:   "ok",
+		},
+		{
+			name: "buffered past deadline",
+			ht:   HandlerTimeout{Timeout: 10 * time.Millisecond},
+			handler: func(w http.ResponseWriter, r *http.Request, release <-chan struct{}) {
+				io.WriteString(w, "partial")
+				<-r.Context().Done()
+				<-release
+				io.WriteString(w, "late")
+			},
+			status:   http.StatusServiceUnavailable,
+			body:     "Service Unavailable",
+			timedOut: true,
+		},
+		{
+			name: "custom status and body",
+			ht:   HandlerTimeout{Timeout: 10 * time.Millisecond, Status: http.StatusGatewayTimeout, Body: "too slow"},
+			handler: func(w http.ResponseWriter, r *http.Request, release <-chan struct{}) {
+				<-r.Context().Done()
+				<-release
+			},
+			status:   http.StatusGatewayTimeout,
+			body:     "too slow",
+			timedOut: true,
+		},
+		{
+			name: "route without limit",
+			ht:   HandlerTimeout{Timeout: 10 * time.Millisecond, Routes: map[string]time.Duration{"/": -1}},
+			handler: func(w http.ResponseWriter, r *http.Request, release <-chan struct{}) {
+				if _, ok := r.Context().Deadline(); ok {
+					t.Error("unexpected deadline")
+				}
+				io.WriteString(w, "ok")
+			},
+			status: http.StatusOK,
+			body:   "ok",
+		},
+		{
+			name: "streamed past deadline",
+			ht:   HandlerTimeout{Timeout: 10 * time.Millisecond},
+			handler: func(w http.ResponseWriter, r *http.Request, release <-chan struct{}) {
+				io.WriteString(w, "a")
+				http.NewResponseController(w).Flush()
+				<-r.Context().Done()
+				// Give the middleware time to see the deadline first.
+				time.Sleep(50 * time.Millisecond)
+				io.WriteString(w, "late")
+			},
+			status:   http.StatusOK,
+			body:     "alate",
+			timedOut: true,
+		},
+		{
+			name:     "client canceled",
+			ht:       HandlerTimeout{Timeout: time.Hour},
+			canceled: true,
+			handler: func(w http.ResponseWriter, r *http.Request, release <-chan struct{}) {
+				<-r.Context().Done()
+				io.WriteString(w, "bye")
+			},
+			status: http.StatusOK,
+			body:   "bye",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			release := make(chan struct{})
+			defer close(release)
+			h := tc.ht.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				tc.handler(w, r, release)
+			}))
+			e := &Entry{}
+			ctx, cancel := context.WithCancel(context.WithValue(context.Background(), entryKey{}, e))
+			defer cancel()
+			if tc.canceled {
+				cancel()
+			}
+			r := httptest.NewRequestWithContext(ctx, "GET", "/", nil)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tc.status || w.Body.String() != tc.body {
+				t.Fatalf("got %d %q, want %d %q", w.Code, w.Body, tc.status, tc.body)
+			}
+			if tc.status == http.StatusCreated && w.Header().Get("X-Test") != "yes" {
+				t.Fatalf("header not sent: %v", w.Header())
+			}
+			if e.TimedOut != tc.timedOut {
+				t.Fatalf("TimedOut = %v, want %v", e.TimedOut, tc.timedOut)
+			}
+		})
+	}
+}
+
+// logLines sends each line logged to it.
+type logLines chan string
+
+func (ll logLines) Write(b []byte) (int, error) {
+	ll <- string(b)
+	return len(b), nil
+}
+
+func TestHandlerTimeoutPanic(t *testing.T) {
+	t.Run("before deadline", func(t *testing.T) {
+		h := (&HandlerTimeout{Timeout: time.Hour}).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panic("boom")
+		}))
+		defer func() {
+			if p := recover(); p != "boom" {
+				t.Fatalf("recovered %v, want boom", p)
+			}
+		}()
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		t.Fatal("panic was swallowed")
+	})
+	t.Run("after deadline", func(t *testing.T) {
+		lines := make(logLines, 1)
+		log.SetOutput(lines)
+		defer log.SetOutput(os.Stderr)
+		release := make(chan struct{})
+		h := (&HandlerTimeout{Timeout: 10 * time.Millisecond}).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+			<-release
+			panic("boom")
+		}))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/?token=secret", nil))
+		close(release)
+		if w.Code != http.StatusServiceUnavailable {
+			t.Fatalf("got %d, want 503", w.Code)
+		}
+		select {
+		case line := <-lines:
+			if !strings.Contains(line, "boom") || strings.Contains(line, "secret") {
+				t.Fatalf("logged %q", line)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("panic after timeout was not logged")
+		}
+	})
+}